@@ -0,0 +1,214 @@
+package ali_mqs
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gogap/errors"
+)
+
+const (
+	MinVisibilityTimeout int64 = 1
+	MaxVisibilityTimeout int64 = 43200
+)
+
+type Backoff interface {
+	Delay(dequeueCount int64) time.Duration
+}
+
+type ExponentialBackoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+}
+
+var (
+	DefaultRedeliveryBackoff Backoff = ExponentialBackoff{
+		Initial:    time.Second * 5,
+		Max:        time.Minute * 10,
+		Multiplier: 2,
+	}
+)
+
+func (p ExponentialBackoff) Delay(dequeueCount int64) time.Duration {
+	if dequeueCount < 1 {
+		dequeueCount = 1
+	}
+
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(p.Initial) * math.Pow(multiplier, float64(dequeueCount-1))
+	if p.Max > 0 && (math.IsInf(delay, 0) || delay > float64(p.Max)) {
+		return p.Max
+	}
+
+	return time.Duration(delay)
+}
+
+type messageReleaser interface {
+	releaseMessage(resp MessageReceiveResponse)
+}
+
+type Message struct {
+	MessageReceiveResponse
+
+	queue   AliMQSQueue
+	backoff Backoff
+
+	locker        sync.Mutex
+	receiptHandle string
+	lease         *MessageLease
+	settled       bool
+}
+
+func NewMessage(queue AliMQSQueue, resp MessageReceiveResponse, backoff ...Backoff) *Message {
+	msg := &Message{
+		MessageReceiveResponse: resp,
+		queue:                  queue,
+		backoff:                DefaultRedeliveryBackoff,
+		receiptHandle:          resp.ReceiptHandle,
+	}
+
+	if len(backoff) > 0 && backoff[0] != nil {
+		msg.backoff = backoff[0]
+	}
+
+	return msg
+}
+
+func (p *Message) Queue() AliMQSQueue {
+	return p.queue
+}
+
+func (p *Message) Settled() bool {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return p.settled
+}
+
+// CurrentReceiptHandle returns the latest receipt handle, which differs from
+// the received one once the visibility has been changed.
+func (p *Message) CurrentReceiptHandle() string {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return p.currentReceiptHandle()
+}
+
+func (p *Message) currentReceiptHandle() string {
+	if p.lease != nil {
+		return p.lease.ReceiptHandle()
+	}
+	return p.receiptHandle
+}
+
+// KeepAlive extends the visibility of the message with keeper until it is
+// acked or nacked, the returned context is canceled if the lease is lost.
+func (p *Message) KeepAlive(parent context.Context, keeper *LeaseKeeper) context.Context {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if p.lease == nil {
+		resp := p.MessageReceiveResponse
+		resp.ReceiptHandle = p.receiptHandle
+		p.lease = keeper.Keep(parent, resp)
+	}
+
+	return p.lease.Context()
+}
+
+// Ack deletes the message and then lets the body filters of the queue release
+// its body, their errors go to the WithReleaseErrorHandler of the queue.
+func (p *Message) Ack() (err error) {
+	if err = p.settle(func(receiptHandle string) error {
+		return p.queue.DeleteMessage(receiptHandle)
+	}); err != nil {
+		return
+	}
+
+	if releaser, ok := p.queue.(messageReleaser); ok {
+		releaser.releaseMessage(p.MessageReceiveResponse)
+	}
+
+	return
+}
+
+func (p *Message) Nack(delay ...time.Duration) (err error) {
+	d := p.backoff.Delay(p.DequeueCount)
+	if len(delay) > 0 {
+		d = delay[0]
+	}
+
+	return p.settle(func(receiptHandle string) (e error) {
+		_, e = p.queue.ChangeMessageVisibility(receiptHandle, toVisibilityTimeout(d))
+		return
+	})
+}
+
+func (p *Message) Extend(d time.Duration) (err error) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if p.settled {
+		err = ERR_MQS_MESSAGE_ALREADY_SETTLED.New(errors.Params{"id": p.MessageId})
+		return
+	}
+
+	if p.lease != nil {
+		err = p.lease.Extend(toVisibilityTimeout(d))
+		return
+	}
+
+	var resp MessageVisibilityChangeResponse
+	if resp, err = p.queue.ChangeMessageVisibility(p.receiptHandle, toVisibilityTimeout(d)); err != nil {
+		return
+	}
+
+	p.receiptHandle = resp.ReceiptHandle
+
+	return
+}
+
+// settle runs request with the current receipt handle and marks the message
+// settled only if it succeeded, so a failed Ack or Nack may be retried. A
+// lease keeps renewing while the request fails and is stopped once it
+// succeeded.
+func (p *Message) settle(request func(receiptHandle string) error) (err error) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if p.settled {
+		err = ERR_MQS_MESSAGE_ALREADY_SETTLED.New(errors.Params{"id": p.MessageId})
+		return
+	}
+
+	if p.lease != nil {
+		if err = p.lease.settle(request); err != nil {
+			return
+		}
+		p.receiptHandle = p.lease.ReceiptHandle()
+		p.lease = nil
+	} else if err = request(p.receiptHandle); err != nil {
+		return
+	}
+
+	p.settled = true
+
+	return
+}
+
+func toVisibilityTimeout(d time.Duration) int64 {
+	seconds := int64(math.Ceil(d.Seconds()))
+	if seconds < MinVisibilityTimeout {
+		return MinVisibilityTimeout
+	} else if seconds > MaxVisibilityTimeout {
+		return MaxVisibilityTimeout
+	}
+	return seconds
+}
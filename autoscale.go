@@ -0,0 +1,234 @@
+package ali_mqs
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAutoscaleInterval         = time.Second * 30
+	DefaultAutoscaleDrainTime        = time.Minute
+	DefaultAutoscaleWorkersPerPoller = 10
+	DefaultAutoscaleHysteresis       = 0.2
+)
+
+type ScaleDecision struct {
+	Time             time.Time     `json:"time"`
+	ActiveMessages   int64         `json:"active_messages"`
+	InactiveMessages int64         `json:"inactive_messages"`
+	DelayMessages    int64         `json:"delay_messages"`
+	Latency          time.Duration `json:"latency"`
+	PreviousPollers  int           `json:"previous_pollers"`
+	PreviousWorkers  int           `json:"previous_workers"`
+	Pollers          int           `json:"pollers"`
+	Workers          int           `json:"workers"`
+	Err              error         `json:"error,omitempty"`
+}
+
+type AutoscaleOptions struct {
+	Interval   time.Duration
+	MinPollers int
+	MaxPollers int
+	MinWorkers int
+	MaxWorkers int
+
+	// DrainTime is how fast the active messages should be handled, the
+	// workers wanted are the active messages times the handling latency
+	// divided by the drain time.
+	DrainTime        time.Duration
+	WorkersPerPoller int
+
+	// Hysteresis is the ratio the wanted workers must fall below the current
+	// ones before scaling down, and DownscaleCooldown the time since the last
+	// change before scaling down again.
+	Hysteresis        float64
+	DownscaleCooldown time.Duration
+
+	OnScale func(decision ScaleDecision)
+}
+
+type Autoscaler struct {
+	consumer   *Consumer
+	attributes QueueAttributeGetter
+	options    AutoscaleOptions
+
+	lastChange time.Time
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	stopChan  chan bool
+	doneChan  chan bool
+}
+
+func NewAutoscaler(consumer *Consumer, options AutoscaleOptions) *Autoscaler {
+	if consumer == nil {
+		panic("ali_mqs: autoscale consumer could not be nil")
+	}
+
+	attributes, ok := consumer.queue.(QueueAttributeGetter)
+	if !ok {
+		panic("ali_mqs: autoscale consumer queue must implement QueueAttributeGetter")
+	}
+
+	if options.Interval <= 0 {
+		options.Interval = DefaultAutoscaleInterval
+	}
+
+	if options.MinPollers <= 0 {
+		options.MinPollers = 1
+	}
+
+	if options.MaxPollers < options.MinPollers {
+		options.MaxPollers = options.MinPollers
+	}
+
+	if options.MinWorkers <= 0 {
+		options.MinWorkers = 1
+	}
+
+	if options.MaxWorkers < options.MinWorkers {
+		options.MaxWorkers = options.MinWorkers
+	}
+
+	if options.DrainTime <= 0 {
+		options.DrainTime = DefaultAutoscaleDrainTime
+	}
+
+	if options.WorkersPerPoller <= 0 {
+		options.WorkersPerPoller = DefaultAutoscaleWorkersPerPoller
+	}
+
+	if options.Hysteresis <= 0 {
+		options.Hysteresis = DefaultAutoscaleHysteresis
+	}
+
+	if options.DownscaleCooldown <= 0 {
+		options.DownscaleCooldown = options.Interval * 3
+	}
+
+	return &Autoscaler{
+		consumer:   consumer,
+		attributes: attributes,
+		options:    options,
+		stopChan:   make(chan bool),
+		doneChan:   make(chan bool),
+	}
+}
+
+func (p *Autoscaler) Start() {
+	p.startOnce.Do(func() {
+		go p.run()
+	})
+}
+
+// Stop waits for a running Scale to finish, an autoscaler stopped before it
+// was started would not start anymore.
+func (p *Autoscaler) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stopChan)
+		p.startOnce.Do(func() {
+			close(p.doneChan)
+		})
+		<-p.doneChan
+	})
+}
+
+func (p *Autoscaler) run() {
+	defer close(p.doneChan)
+
+	ticker := time.NewTicker(p.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stopChan:
+			return
+		case <-ticker.C:
+			p.Scale()
+		}
+	}
+}
+
+// Scale samples the queue and the consumer once and applies the decision.
+func (p *Autoscaler) Scale() (decision ScaleDecision) {
+	decision = ScaleDecision{
+		Time:            time.Now(),
+		Latency:         p.consumer.Latency(),
+		PreviousPollers: p.consumer.Pollers(),
+		PreviousWorkers: p.consumer.Workers(),
+	}
+
+	decision.Pollers = decision.PreviousPollers
+	decision.Workers = decision.PreviousWorkers
+
+	attr, err := p.attributes.GetAttributes()
+	if err != nil {
+		decision.Err = err
+		p.notify(decision)
+		return
+	}
+
+	decision.ActiveMessages = attr.ActiveMessages
+	decision.InactiveMessages = attr.InactiveMessages
+	decision.DelayMessages = attr.DelayMessages
+
+	workers := p.wantedWorkers(attr.ActiveMessages, decision.Latency)
+
+	switch {
+	case workers > decision.PreviousWorkers:
+	case float64(workers) < float64(decision.PreviousWorkers)*(1-p.options.Hysteresis) &&
+		decision.Time.Sub(p.lastChange) >= p.options.DownscaleCooldown:
+	default:
+		workers = decision.PreviousWorkers
+	}
+
+	pollers := clampInt((workers+p.options.WorkersPerPoller-1)/p.options.WorkersPerPoller, p.options.MinPollers, p.options.MaxPollers)
+
+	if workers != decision.PreviousWorkers {
+		p.consumer.SetWorkers(workers)
+	}
+
+	if pollers != decision.PreviousPollers {
+		p.consumer.SetPollers(pollers)
+	}
+
+	decision.Pollers = p.consumer.Pollers()
+	decision.Workers = p.consumer.Workers()
+
+	if decision.Pollers != decision.PreviousPollers || decision.Workers != decision.PreviousWorkers {
+		p.lastChange = decision.Time
+	}
+
+	p.notify(decision)
+
+	return
+}
+
+func (p *Autoscaler) wantedWorkers(activeMessages int64, latency time.Duration) int {
+	if latency <= 0 {
+		latency = time.Second
+	}
+
+	wanted := math.Ceil(float64(activeMessages) * float64(latency) / float64(p.options.DrainTime))
+	if wanted > float64(p.options.MaxWorkers) {
+		return p.options.MaxWorkers
+	}
+
+	return clampInt(int(wanted), p.options.MinWorkers, p.options.MaxWorkers)
+}
+
+func (p *Autoscaler) notify(decision ScaleDecision) {
+	if p.options.OnScale != nil {
+		p.options.OnScale(decision)
+	}
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	} else if v > max {
+		return max
+	}
+	return v
+}
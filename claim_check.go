@@ -0,0 +1,186 @@
+package ali_mqs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gogap/errors"
+)
+
+const (
+	bodyHeaderBlobRef = "ref"
+
+	// bodies are base64 encoded on the wire, so a body of 3/4 of the max
+	// message size is the largest that always fits
+	DefaultClaimCheckThreshold = 65536 / 4 * 3
+)
+
+type BlobStore interface {
+	Put(data []byte) (key string, err error)
+	Get(key string) (data []byte, err error)
+	Delete(key string) (err error)
+}
+
+type BodyReleaser interface {
+	ReleaseBody(body []byte) (err error)
+}
+
+// ClaimCheckFilter stores bodies larger than threshold in a blob store and
+// sends a reference instead, receivers resolve the reference and the blob is
+// deleted once the message is acked. It should be the last body filter so
+// the reference is what goes on the wire.
+//
+// Only Message.Ack deletes blobs. Messages received with ReceiveMessage and
+// deleted with DeleteMessage, messages which could not be decoded and those
+// dropped after the retention period keep theirs, so the store should
+// expire old blobs, like FileBlobStore.Expire.
+type ClaimCheckFilter struct {
+	store     BlobStore
+	threshold int
+}
+
+func NewClaimCheckFilter(store BlobStore, threshold int) *ClaimCheckFilter {
+	if store == nil {
+		panic("ali_mqs: claim check blob store could not be nil")
+	}
+
+	if threshold <= 0 {
+		threshold = DefaultClaimCheckThreshold
+	}
+
+	return &ClaimCheckFilter{
+		store:     store,
+		threshold: threshold,
+	}
+}
+
+func (p *ClaimCheckFilter) EncodeBody(body []byte) (encoded []byte, err error) {
+	if len(body) <= p.threshold {
+		return body, nil
+	}
+
+	var key string
+	if key, err = p.store.Put(body); err != nil {
+		err = ERR_MQS_BLOB_STORE_FAILED.New(errors.Params{"op": "put", "key": "", "err": err})
+		return
+	}
+
+	return encodeBodyHeader(bodyHeaderBlobRef, key, nil), nil
+}
+
+func (p *ClaimCheckFilter) DecodeBody(body []byte) (decoded []byte, err error) {
+	key, _, ok := decodeBodyHeader(body, bodyHeaderBlobRef)
+	if !ok {
+		return body, nil
+	}
+
+	if decoded, err = p.store.Get(key); err != nil {
+		err = ERR_MQS_BLOB_STORE_FAILED.New(errors.Params{"op": "get", "key": key, "err": err})
+		return
+	}
+
+	return
+}
+
+func (p *ClaimCheckFilter) ReleaseBody(body []byte) (err error) {
+	key, _, ok := decodeBodyHeader(body, bodyHeaderBlobRef)
+	if !ok {
+		return
+	}
+
+	if err = p.store.Delete(key); err != nil {
+		err = ERR_MQS_BLOB_STORE_FAILED.New(errors.Params{"op": "delete", "key": key, "err": err})
+		return
+	}
+
+	return
+}
+
+type FileBlobStore struct {
+	dir string
+}
+
+func NewFileBlobStore(dir string) (store *FileBlobStore, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	return &FileBlobStore{dir: dir}, nil
+}
+
+func (p *FileBlobStore) Put(data []byte) (key string, err error) {
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		return
+	}
+
+	key = hex.EncodeToString(id)
+	filename := p.filename(key)
+
+	if err = ioutil.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return
+	}
+
+	err = os.Rename(filename+".tmp", filename)
+
+	return
+}
+
+func (p *FileBlobStore) Get(key string) (data []byte, err error) {
+	if err = checkBlobKey(key); err != nil {
+		return
+	}
+
+	return ioutil.ReadFile(p.filename(key))
+}
+
+func (p *FileBlobStore) Delete(key string) (err error) {
+	if err = checkBlobKey(key); err != nil {
+		return
+	}
+
+	if err = os.Remove(p.filename(key)); os.IsNotExist(err) {
+		err = nil
+	}
+
+	return
+}
+
+// Expire deletes blobs older than age, which collects the blobs of messages
+// deleted without Ack or dropped after the retention period.
+func (p *FileBlobStore) Expire(age time.Duration) (count int, err error) {
+	var infos []os.FileInfo
+	if infos, err = ioutil.ReadDir(p.dir); err != nil {
+		return
+	}
+
+	deadline := time.Now().Add(-age)
+	for _, info := range infos {
+		if info.IsDir() || info.ModTime().After(deadline) {
+			continue
+		}
+
+		if e := os.Remove(filepath.Join(p.dir, info.Name())); e == nil {
+			count++
+		}
+	}
+
+	return
+}
+
+func (p *FileBlobStore) filename(key string) string {
+	return filepath.Join(p.dir, key)
+}
+
+func checkBlobKey(key string) (err error) {
+	if key == "" || strings.ContainsAny(key, `/\.`) {
+		err = ERR_MQS_INVALID_BLOB_KEY.New(errors.Params{"key": key})
+		return
+	}
+	return
+}
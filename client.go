@@ -2,6 +2,7 @@ package ali_mqs
 
 import (
 	"crypto/md5"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/xml"
 	"fmt"
@@ -38,6 +39,38 @@ type MQSClient interface {
 	SetProxy(url string)
 }
 
+type ClientOption func(client *AliMQSClient)
+
+// ClientFactory creates the clients of a queue manager, NewAliMQSClient is
+// the default.
+type ClientFactory func(url, accessKeyId, accessKeySecret string, options ...ClientOption) MQSClient
+
+// WithClientTimeout sets the request timeout in seconds.
+func WithClientTimeout(seconds int64) ClientOption {
+	return func(client *AliMQSClient) {
+		client.Timeout = seconds
+	}
+}
+
+func WithTLSConfig(config *tls.Config) ClientOption {
+	return func(client *AliMQSClient) {
+		client.tlsConfig = config
+	}
+}
+
+// WithRetry retries requests failing with a transient error up to maxRetries
+// times, waiting with backoff in between. Retried sends may be duplicated if
+// the first request reached the service.
+func WithRetry(maxRetries int, backoff Backoff) ClientOption {
+	return func(client *AliMQSClient) {
+		if backoff == nil {
+			backoff = DefaultSendRetryBackoff
+		}
+		client.maxRetries = maxRetries
+		client.retryBackoff = backoff
+	}
+}
+
 type AliMQSClient struct {
 	Timeout      int64
 	url          string
@@ -46,9 +79,12 @@ type AliMQSClient struct {
 	clientLocker sync.Mutex
 	client       *http.Client
 	proxyURL     string
+	tlsConfig    *tls.Config
+	maxRetries   int
+	retryBackoff Backoff
 }
 
-func NewAliMQSClient(url, accessKeyId, accessKeySecret string) MQSClient {
+func NewAliMQSClient(url, accessKeyId, accessKeySecret string, options ...ClientOption) MQSClient {
 	if url == "" {
 		panic("ali-mqs: message queue url is empty")
 	}
@@ -60,6 +96,10 @@ func NewAliMQSClient(url, accessKeyId, accessKeySecret string) MQSClient {
 	aliMQSClient.accessKeyId = accessKeyId
 	aliMQSClient.url = url
 
+	for _, option := range options {
+		option(aliMQSClient)
+	}
+
 	timeoutInt := DefaultTimeout
 
 	if aliMQSClient.Timeout > 0 {
@@ -73,6 +113,7 @@ func NewAliMQSClient(url, accessKeyId, accessKeySecret string) MQSClient {
 		ConnectTimeout:        time.Second * 3,
 		RequestTimeout:        timeout,
 		ResponseHeaderTimeout: timeout + time.Second,
+		TLSClientConfig:       aliMQSClient.tlsConfig,
 	}
 
 	aliMQSClient.client = &http.Client{Transport: transport}
@@ -81,12 +122,22 @@ func NewAliMQSClient(url, accessKeyId, accessKeySecret string) MQSClient {
 }
 
 func (p *AliMQSClient) SetProxy(url string) {
+	p.clientLocker.Lock()
+	defer p.clientLocker.Unlock()
+
 	p.url = url
 }
 
+func (p *AliMQSClient) getURL() string {
+	p.clientLocker.Lock()
+	defer p.clientLocker.Unlock()
+
+	return p.url
+}
+
 func (p *AliMQSClient) proxy(req *http.Request) (*url.URL, error) {
-	if p.url != "" {
-		return url.Parse(p.url)
+	if proxyURL := p.getURL(); proxyURL != "" {
+		return url.Parse(proxyURL)
 	}
 	return nil, nil
 }
@@ -102,6 +153,17 @@ func (p *AliMQSClient) authorization(method Method, headers map[string]string, r
 }
 
 func (p *AliMQSClient) Send(method Method, headers map[string]string, message interface{}, resource string, v interface{}) (statusCode int, err error) {
+	for retries := 0; ; retries++ {
+		statusCode, err = p.send(method, headers, message, resource, v)
+		if err == nil || retries >= p.maxRetries || !IsTransientError(err) {
+			return
+		}
+
+		time.Sleep(p.retryBackoff.Delay(int64(retries + 1)))
+	}
+}
+
+func (p *AliMQSClient) send(method Method, headers map[string]string, message interface{}, resource string, v interface{}) (statusCode int, err error) {
 	var xmlContent []byte
 
 	if message == nil {
@@ -134,13 +196,10 @@ func (p *AliMQSClient) Send(method Method, headers map[string]string, message in
 		headers[AUTHORIZATION] = authHeader
 	}
 
-	url := p.url + "/" + resource
+	url := p.getURL() + "/" + resource
 
 	postBodyReader := strings.NewReader(string(xmlContent))
 
-	p.clientLocker.Lock()
-	defer p.clientLocker.Unlock()
-
 	var req *http.Request
 	if req, err = http.NewRequest(string(method), url, postBodyReader); err != nil {
 		err = ERR_CREATE_NEW_REQUEST_FAILED.New(errors.Params{"err": err})
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+
+	"github.com/gogap/ali_mqs"
+	"gopkg.in/yaml.v2"
+)
+
+type appConf struct {
+	OwnerId         string `json:"owner_id"`
+	AccessKeyId     string `json:"access_key_id"`
+	AccessKeySecret string `json:"access_key_secret"`
+	BaseURL         string `json:"base_url"`
+}
+
+func main() {
+	confFile := flag.String("conf", "app.conf", "config file with owner_id, access_key_id, access_key_secret and an optional base_url")
+	specFile := flag.String("spec", "queues.yaml", "yaml or json spec of the queues of each location")
+	apply := flag.Bool("apply", false, "apply the plan instead of only printing it")
+	prune := flag.Bool("prune", false, "delete queues matching the location prefix which are missing from the spec")
+	pruneAll := flag.Bool("prune-all", false, "prune locations without a prefix too, deleting all their queues which are missing from the spec")
+	flag.Parse()
+
+	conf := appConf{}
+
+	if bFile, e := ioutil.ReadFile(*confFile); e != nil {
+		panic(e)
+	} else {
+		if e := json.Unmarshal(bFile, &conf); e != nil {
+			panic(e)
+		}
+	}
+
+	spec, err := loadSpec(*specFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	manager := ali_mqs.NewMQSQueueManager(conf.OwnerId, conf.AccessKeyId, conf.AccessKeySecret,
+		ali_mqs.WithEndpointResolver(ali_mqs.Endpoint{BaseURL: conf.BaseURL}))
+
+	provisioner := ali_mqs.NewProvisioner(manager, ali_mqs.ProvisionOptions{
+		Prune:    *prune || *pruneAll,
+		PruneAll: *pruneAll,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	plan, err := provisioner.Plan(ctx, spec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Print(plan)
+
+	if !*apply || plan.IsEmpty() {
+		return
+	}
+
+	applied, err := provisioner.Apply(ctx, plan)
+
+	fmt.Printf("applied: %d of %d\n", applied, len(plan.Steps))
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// loadSpec reads YAML, and JSON as JSON is valid YAML.
+func loadSpec(filename string) (spec ali_mqs.ProvisionSpec, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(filename); err != nil {
+		return
+	}
+
+	if err = yaml.Unmarshal(data, &spec); err != nil {
+		return
+	}
+
+	err = spec.Check()
+
+	return
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+
+	"github.com/gogap/ali_mqs"
+)
+
+type appConf struct {
+	Url             string `json:"url"`
+	AccessKeyId     string `json:"access_key_id"`
+	AccessKeySecret string `json:"access_key_secret"`
+}
+
+func main() {
+	confFile := flag.String("conf", "app.conf", "config file with url, access_key_id and access_key_secret")
+	source := flag.String("source", "", "queue to move messages from, usually the dead letter queue")
+	target := flag.String("target", "", "queue to move messages to")
+	maxMessages := flag.Int64("max", 0, "max messages to move, 0 means until the source queue is empty")
+	waitSeconds := flag.Int64("wait", 0, "long polling wait seconds of each receive")
+	raw := flag.Bool("raw", false, "send message bodies as they are instead of unwrapping dead letters")
+	flag.Parse()
+
+	if *source == "" || *target == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	conf := appConf{}
+
+	if bFile, e := ioutil.ReadFile(*confFile); e != nil {
+		panic(e)
+	} else {
+		if e := json.Unmarshal(bFile, &conf); e != nil {
+			panic(e)
+		}
+	}
+
+	sourceQueue := ali_mqs.NewMQSQueue(*source, ali_mqs.NewAliMQSClient(conf.Url, conf.AccessKeyId, conf.AccessKeySecret))
+	targetQueue := ali_mqs.NewMQSQueue(*target, ali_mqs.NewAliMQSClient(conf.Url, conf.AccessKeyId, conf.AccessKeySecret))
+
+	options := ali_mqs.RedriveOptions{
+		MaxMessages: *maxMessages,
+		WaitSeconds: *waitSeconds,
+	}
+
+	if *raw {
+		options.Transform = func(resp ali_mqs.MessageReceiveResponse) (ali_mqs.MessageSendRequest, error) {
+			return ali_mqs.MessageSendRequest{MessageBody: resp.MessageBody, Priority: resp.Priority}, nil
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	result, err := ali_mqs.Redrive(ctx, sourceQueue, targetQueue, options)
+
+	fmt.Printf("received: %d, sent: %d, skipped: %d, failed: %d\n", result.Received, result.Sent, result.Skipped, result.Failed)
+	for _, failure := range result.Failures {
+		fmt.Printf("failed: %s, %s\n", failure.MessageId, failure.Err)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if result.Failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,178 @@
+package ali_mqs
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"reflect"
+	"sync"
+
+	"github.com/gogap/errors"
+)
+
+const (
+	bodyHeaderContentType = "ct"
+)
+
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type JSONCodec struct{}
+
+func (p JSONCodec) ContentType() string                        { return "application/json" }
+func (p JSONCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (p JSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type XMLCodec struct{}
+
+func (p XMLCodec) ContentType() string                        { return "application/xml" }
+func (p XMLCodec) Marshal(v interface{}) ([]byte, error)      { return xml.Marshal(v) }
+func (p XMLCodec) Unmarshal(data []byte, v interface{}) error { return xml.Unmarshal(data, v) }
+
+var (
+	codecsLocker sync.RWMutex
+	codecs       = map[string]Codec{}
+)
+
+func init() {
+	RegisterCodec(JSONCodec{})
+	RegisterCodec(XMLCodec{})
+}
+
+func RegisterCodec(codec Codec) {
+	codecsLocker.Lock()
+	defer codecsLocker.Unlock()
+
+	codecs[codec.ContentType()] = codec
+}
+
+func GetCodec(contentType string) (codec Codec, exist bool) {
+	codecsLocker.RLock()
+	defer codecsLocker.RUnlock()
+
+	codec, exist = codecs[contentType]
+	return
+}
+
+// EncodeBody marshals v with codec and records the content type in front of
+// the payload.
+func EncodeBody(codec Codec, v interface{}) (body []byte, err error) {
+	var payload []byte
+	if payload, err = codec.Marshal(v); err != nil {
+		err = ERR_MQS_CODEC_MARSHAL_FAILED.New(errors.Params{"content_type": codec.ContentType(), "err": err})
+		return
+	}
+
+	body = encodeBodyHeader(bodyHeaderContentType, codec.ContentType(), payload)
+
+	return
+}
+
+// DecodeBody unmarshals body into v with the codec of the recorded content
+// type, or with defaultCodec if the body has none.
+func DecodeBody(body []byte, v interface{}, defaultCodec Codec) (err error) {
+	codec := defaultCodec
+
+	contentType, payload, ok := decodeBodyHeader(body, bodyHeaderContentType)
+	if ok {
+		var exist bool
+		if codec, exist = GetCodec(contentType); !exist {
+			err = ERR_MQS_CODEC_NOT_REGISTERED.New(errors.Params{"content_type": contentType})
+			return
+		}
+	}
+
+	if err = codec.Unmarshal(payload, v); err != nil {
+		err = ERR_MQS_CODEC_UNMARSHAL_FAILED.New(errors.Params{"content_type": codec.ContentType(), "err": err})
+		return
+	}
+
+	return
+}
+
+type TypedHandler[T any] func(ctx context.Context, v T, msg *Message) error
+
+type TypedQueue[T any] struct {
+	queue AliMQSQueue
+	codec Codec
+}
+
+func NewTypedQueue[T any](queue AliMQSQueue, codec Codec) *TypedQueue[T] {
+	if queue == nil {
+		panic("ali_mqs: typed queue could not be nil")
+	}
+
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+
+	return &TypedQueue[T]{
+		queue: queue,
+		codec: codec,
+	}
+}
+
+func (p *TypedQueue[T]) Queue() AliMQSQueue {
+	return p.queue
+}
+
+func (p *TypedQueue[T]) Send(v T) (resp MessageSendResponse, err error) {
+	return p.SendMessage(v, 0, 0)
+}
+
+func (p *TypedQueue[T]) SendMessage(v T, delaySeconds int64, priority int64) (resp MessageSendResponse, err error) {
+	var body []byte
+	if body, err = EncodeBody(p.codec, v); err != nil {
+		return
+	}
+
+	return p.queue.SendMessage(MessageSendRequest{
+		MessageBody:  body,
+		DelaySeconds: delaySeconds,
+		Priority:     priority,
+	})
+}
+
+func (p *TypedQueue[T]) Decode(msg *Message) (v T, err error) {
+	// pointer types such as protobuf messages are allocated and decoded into
+	target := interface{}(&v)
+	if typ := reflect.TypeOf(v); typ != nil && typ.Kind() == reflect.Ptr {
+		v = reflect.New(typ.Elem()).Interface().(T)
+		target = v
+	}
+
+	err = DecodeBody(msg.MessageBody, target, p.codec)
+
+	return
+}
+
+func (p *TypedQueue[T]) Receive(ctx context.Context, waitseconds ...int64) (v T, msg *Message, err error) {
+	var receiver MessageReceiver
+	if receiver, err = receiverOf(p.queue); err != nil {
+		return
+	}
+
+	if msg, err = receiver.Receive(ctx, waitseconds...); err != nil {
+		return
+	}
+
+	v, err = p.Decode(msg)
+
+	return
+}
+
+// Handler adapts handler to a MessageHandler for Consumer, a message which
+// could not be decoded fails without calling handler.
+func (p *TypedQueue[T]) Handler(handler TypedHandler[T]) MessageHandler {
+	return func(ctx context.Context, msg *Message) (err error) {
+		var v T
+		if v, err = p.Decode(msg); err != nil {
+			return
+		}
+
+		return handler(ctx, v, msg)
+	}
+}
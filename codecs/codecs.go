@@ -0,0 +1,41 @@
+// Package codecs holds the codecs with third party dependencies, importing it
+// registers them so DecodeBody finds them by content type.
+package codecs
+
+import (
+	"reflect"
+
+	"github.com/gogap/ali_mqs"
+	"github.com/gogap/errors"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+func init() {
+	ali_mqs.RegisterCodec(MsgpackCodec{})
+	ali_mqs.RegisterCodec(ProtobufCodec{})
+}
+
+type MsgpackCodec struct{}
+
+func (p MsgpackCodec) ContentType() string                        { return "application/msgpack" }
+func (p MsgpackCodec) Marshal(v interface{}) ([]byte, error)      { return msgpack.Marshal(v) }
+func (p MsgpackCodec) Unmarshal(data []byte, v interface{}) error { return msgpack.Unmarshal(data, v) }
+
+type ProtobufCodec struct{}
+
+func (p ProtobufCodec) ContentType() string { return "application/protobuf" }
+
+func (p ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	if pb, ok := v.(proto.Message); ok {
+		return proto.Marshal(pb)
+	}
+	return nil, ali_mqs.ERR_MQS_CODEC_UNSUPPORTED_TYPE.New(errors.Params{"content_type": p.ContentType(), "type": reflect.TypeOf(v)})
+}
+
+func (p ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	if pb, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, pb)
+	}
+	return ali_mqs.ERR_MQS_CODEC_UNSUPPORTED_TYPE.New(errors.Params{"content_type": p.ContentType(), "type": reflect.TypeOf(v)})
+}
@@ -0,0 +1,129 @@
+package ali_mqs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"sync"
+
+	"github.com/gogap/errors"
+)
+
+const (
+	bodyHeaderCompression = "z"
+
+	DefaultCompressionThreshold = 1024
+)
+
+type Compressor interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+type GzipCompressor struct{}
+
+func (p GzipCompressor) Name() string { return "gzip" }
+
+func (p GzipCompressor) Compress(data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	writer := gzip.NewWriter(buf)
+	if _, e := writer.Write(data); e != nil {
+		return nil, e
+	}
+	if e := writer.Close(); e != nil {
+		return nil, e
+	}
+	return buf.Bytes(), nil
+}
+
+func (p GzipCompressor) Decompress(data []byte) ([]byte, error) {
+	reader, e := gzip.NewReader(bytes.NewReader(data))
+	if e != nil {
+		return nil, e
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+var (
+	compressorsLocker sync.RWMutex
+	compressors       = map[string]Compressor{}
+)
+
+func init() {
+	RegisterCompressor(GzipCompressor{})
+}
+
+func RegisterCompressor(compressor Compressor) {
+	compressorsLocker.Lock()
+	defer compressorsLocker.Unlock()
+
+	compressors[compressor.Name()] = compressor
+}
+
+func GetCompressor(name string) (compressor Compressor, exist bool) {
+	compressorsLocker.RLock()
+	defer compressorsLocker.RUnlock()
+
+	compressor, exist = compressors[name]
+	return
+}
+
+// CompressionFilter compresses bodies of at least threshold bytes and marks
+// them with the compressor name, so receivers decompress with any of the
+// registered compressors. Smaller bodies, and bodies compression would not
+// shrink, are sent raw.
+type CompressionFilter struct {
+	compressor Compressor
+	threshold  int
+}
+
+func NewCompressionFilter(compressor Compressor, threshold int) *CompressionFilter {
+	if compressor == nil {
+		compressor = GzipCompressor{}
+	}
+
+	if threshold <= 0 {
+		threshold = DefaultCompressionThreshold
+	}
+
+	return &CompressionFilter{
+		compressor: compressor,
+		threshold:  threshold,
+	}
+}
+
+func (p *CompressionFilter) EncodeBody(body []byte) (encoded []byte, err error) {
+	if len(body) < p.threshold {
+		return body, nil
+	}
+
+	var compressed []byte
+	if compressed, err = p.compressor.Compress(body); err != nil {
+		return
+	}
+
+	encoded = encodeBodyHeader(bodyHeaderCompression, p.compressor.Name(), compressed)
+	if len(encoded) >= len(body) {
+		return body, nil
+	}
+
+	return
+}
+
+func (p *CompressionFilter) DecodeBody(body []byte) (decoded []byte, err error) {
+	name, payload, ok := decodeBodyHeader(body, bodyHeaderCompression)
+	if !ok {
+		return body, nil
+	}
+
+	compressor, exist := GetCompressor(name)
+	if !exist {
+		err = ERR_MQS_COMPRESSOR_NOT_REGISTERED.New(errors.Params{"name": name})
+		return
+	}
+
+	return compressor.Decompress(payload)
+}
@@ -0,0 +1,61 @@
+// Package compressors holds the compressors with third party dependencies,
+// importing it registers them so CompressionFilter decompresses their bodies.
+package compressors
+
+import (
+	"sync"
+
+	"github.com/gogap/ali_mqs"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+func init() {
+	ali_mqs.RegisterCompressor(SnappyCompressor{})
+	ali_mqs.RegisterCompressor(&ZstdCompressor{})
+}
+
+type SnappyCompressor struct{}
+
+func (p SnappyCompressor) Name() string { return "snappy" }
+
+func (p SnappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (p SnappyCompressor) Decompress(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
+
+type ZstdCompressor struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func (p *ZstdCompressor) Name() string { return "zstd" }
+
+func (p *ZstdCompressor) init() error {
+	p.once.Do(func() {
+		if p.encoder, p.err = zstd.NewWriter(nil); p.err != nil {
+			return
+		}
+		p.decoder, p.err = zstd.NewReader(nil)
+	})
+	return p.err
+}
+
+func (p *ZstdCompressor) Compress(data []byte) ([]byte, error) {
+	if e := p.init(); e != nil {
+		return nil, e
+	}
+	return p.encoder.EncodeAll(data, nil), nil
+}
+
+func (p *ZstdCompressor) Decompress(data []byte) ([]byte, error) {
+	if e := p.init(); e != nil {
+		return nil, e
+	}
+	return p.decoder.DecodeAll(data, nil)
+}
@@ -0,0 +1,550 @@
+package ali_mqs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogap/errors"
+)
+
+const (
+	DefaultConsumerPollers  = 1
+	DefaultConsumerWorkers  = 10
+	DefaultConsumerLaneSize = 10
+)
+
+type PartitionKeyFunc func(msg *Message) string
+
+func PartitionByJSONField(field string) PartitionKeyFunc {
+	return func(msg *Message) string {
+		fields := map[string]interface{}{}
+		if e := json.Unmarshal(msg.MessageBody, &fields); e != nil {
+			return ""
+		}
+
+		if v, exist := fields[field]; exist && v != nil {
+			return fmt.Sprint(v)
+		}
+
+		return ""
+	}
+}
+
+type ConsumerOptions struct {
+	Pollers     int
+	Workers     int
+	WaitSeconds int64
+
+	// VisibilityTimeout enables lease renewal for messages waiting in a lane
+	// or being handled, the handler context is canceled if a lease is lost.
+	VisibilityTimeout int64
+
+	// PartitionKey enables ordered mode: messages with the same key are
+	// handled one at a time in the order they were received, by a single
+	// poller and with leases renewed. A failed message holds its lane and is
+	// retried in place with its redelivery backoff. If its lease is lost or
+	// the consumer stops it is nacked, and so are the messages of its key
+	// behind it until it comes back. Messages without a key go to the first
+	// lane and are not held.
+	PartitionKey PartitionKeyFunc
+	LaneSize     int
+
+	// RateLimit is the max messages received per second with RateBurst, and
+	// MaxInFlight the max messages received but not yet handled. Both are
+	// applied before polling so excess messages stay in the queue.
+	RateLimit   float64
+	RateBurst   int
+	MaxInFlight int
+
+	OnError func(msg *Message, err error)
+
+	// OnDecodeError settles messages the body filters could not decode, msg
+	// holds the body as received. The message is acked if it returns nil and
+	// nacked otherwise, unless it settled the message itself, so a
+	// DeadLetterRouter's Route fits. Without it tampered messages, which
+	// would never decode, are deleted and other ones nacked. Either way err
+	// goes to OnError too.
+	OnDecodeError func(msg *Message, err *MessageDecodeError) error
+}
+
+type Consumer struct {
+	queue    AliMQSQueue
+	receiver MessageReceiver
+	handler  MessageHandler
+	options  ConsumerOptions
+	keeper   *LeaseKeeper
+
+	rateLimiter     *RateLimiter
+	inFlightLimiter *InFlightLimiter
+
+	lanes []chan *Message
+
+	scaleLocker  sync.Mutex
+	pollerStops  []context.CancelFunc
+	workerStops  []chan bool
+	latencyNanos int64
+
+	ctx         context.Context
+	cancel      context.CancelFunc
+	startOnce   sync.Once
+	stopOnce    sync.Once
+	pollerGroup sync.WaitGroup
+	workerGroup sync.WaitGroup
+}
+
+// NewConsumer creates a consumer calling handler wrapped by middlewares, the
+// first middleware being the outermost. A message is acked when the handler
+// returns nil and nacked otherwise, unless the handler already settled it.
+func NewConsumer(queue AliMQSQueue, handler MessageHandler, options ConsumerOptions, middlewares ...MessageMiddleware) *Consumer {
+	if queue == nil {
+		panic("ali_mqs: consumer queue could not be nil")
+	}
+
+	receiver, ok := queue.(MessageReceiver)
+	if !ok {
+		panic("ali_mqs: consumer queue must implement MessageReceiver")
+	}
+
+	if handler == nil {
+		panic("ali_mqs: consumer handler could not be nil")
+	}
+
+	if options.Pollers <= 0 || options.PartitionKey != nil {
+		options.Pollers = DefaultConsumerPollers
+	}
+
+	if options.PartitionKey != nil && options.VisibilityTimeout <= 0 {
+		options.VisibilityTimeout = DefaultLeaseVisibilityTimeout
+	}
+
+	if options.Workers <= 0 {
+		options.Workers = DefaultConsumerWorkers
+	}
+
+	if options.LaneSize <= 0 {
+		options.LaneSize = DefaultConsumerLaneSize
+	}
+
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	consumer := &Consumer{
+		queue:           queue,
+		receiver:        receiver,
+		handler:         handler,
+		options:         options,
+		rateLimiter:     NewRateLimiter(options.RateLimit, options.RateBurst),
+		inFlightLimiter: NewInFlightLimiter(options.MaxInFlight),
+	}
+
+	if options.VisibilityTimeout > 0 {
+		consumer.keeper = NewLeaseKeeper(queue, options.VisibilityTimeout)
+	}
+
+	consumer.ctx, consumer.cancel = context.WithCancel(context.Background())
+
+	return consumer
+}
+
+func (p *Consumer) Start() {
+	p.startOnce.Do(func() {
+		p.scaleLocker.Lock()
+
+		laneCount := 1
+		if p.options.PartitionKey != nil {
+			laneCount = p.options.Workers
+		}
+
+		lanes := make([]chan *Message, laneCount)
+		for i := range lanes {
+			lanes[i] = make(chan *Message, p.options.LaneSize)
+		}
+
+		p.lanes = lanes
+		workers, pollers := p.options.Workers, p.options.Pollers
+
+		p.scaleLocker.Unlock()
+
+		p.SetWorkers(workers)
+		p.SetPollers(pollers)
+	})
+}
+
+func (p *Consumer) Pollers() int {
+	p.scaleLocker.Lock()
+	defer p.scaleLocker.Unlock()
+
+	return len(p.pollerStops)
+}
+
+func (p *Consumer) Workers() int {
+	p.scaleLocker.Lock()
+	defer p.scaleLocker.Unlock()
+
+	return len(p.workerStops)
+}
+
+// SetPollers changes the poller count, before Start it sets the count to
+// start with. In ordered mode the count stays 1, as messages received by
+// concurrent polls could be put into a lane out of order.
+func (p *Consumer) SetPollers(count int) {
+	p.scaleLocker.Lock()
+	defer p.scaleLocker.Unlock()
+
+	if p.ctx.Err() != nil {
+		return
+	}
+
+	if p.options.PartitionKey != nil {
+		count = 1
+	}
+
+	if p.lanes == nil {
+		if count > 0 {
+			p.options.Pollers = count
+		}
+		return
+	}
+
+	for len(p.pollerStops) < count {
+		ctx, cancel := context.WithCancel(p.ctx)
+		p.pollerStops = append(p.pollerStops, cancel)
+		p.pollerGroup.Add(1)
+		go p.poll(ctx)
+	}
+
+	for len(p.pollerStops) > count && len(p.pollerStops) > 1 {
+		last := len(p.pollerStops) - 1
+		p.pollerStops[last]()
+		p.pollerStops = p.pollerStops[:last]
+	}
+}
+
+// SetWorkers changes the worker count, in ordered mode every lane keeps
+// exactly one worker so the count is fixed to the lanes. Before Start it sets
+// the count to start with.
+func (p *Consumer) SetWorkers(count int) {
+	p.scaleLocker.Lock()
+	defer p.scaleLocker.Unlock()
+
+	if p.ctx.Err() != nil {
+		return
+	}
+
+	if p.lanes == nil {
+		if count > 0 {
+			p.options.Workers = count
+		}
+		return
+	}
+
+	if len(p.lanes) > 1 {
+		count = len(p.lanes)
+	}
+
+	for len(p.workerStops) < count {
+		stopChan := make(chan bool)
+		p.workerStops = append(p.workerStops, stopChan)
+		p.workerGroup.Add(1)
+		go p.work(p.lanes[(len(p.workerStops)-1)%len(p.lanes)], stopChan)
+	}
+
+	for len(p.workerStops) > count && len(p.workerStops) > 1 {
+		last := len(p.workerStops) - 1
+		close(p.workerStops[last])
+		p.workerStops = p.workerStops[:last]
+	}
+}
+
+// Latency returns the moving average of the handling time.
+func (p *Consumer) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.latencyNanos))
+}
+
+func (p *Consumer) SetRateLimit(rate float64, burst int) {
+	p.rateLimiter.SetRate(rate, burst)
+}
+
+func (p *Consumer) SetMaxInFlight(max int) {
+	p.inFlightLimiter.SetMax(max)
+}
+
+func (p *Consumer) InFlight() int {
+	return p.inFlightLimiter.Count()
+}
+
+// Stop stops polling and returns once the messages already received are
+// handled.
+func (p *Consumer) Stop() {
+	p.stopOnce.Do(func() {
+		p.scaleLocker.Lock()
+		p.cancel()
+		p.scaleLocker.Unlock()
+
+		p.pollerGroup.Wait()
+
+		for _, lane := range p.lanes {
+			close(lane)
+		}
+
+		p.workerGroup.Wait()
+	})
+}
+
+func (p *Consumer) poll(ctx context.Context) {
+	defer p.pollerGroup.Done()
+
+	var waitseconds []int64
+	if p.options.WaitSeconds > 0 {
+		waitseconds = []int64{p.options.WaitSeconds}
+	}
+
+	failures := int64(0)
+
+	for {
+		if p.inFlightLimiter.Acquire(ctx) != nil {
+			return
+		}
+
+		if p.rateLimiter.Wait(ctx) != nil {
+			p.inFlightLimiter.Release()
+			return
+		}
+
+		msg, err := p.receiver.Receive(ctx, waitseconds...)
+
+		if ctx.Err() != nil {
+			if msg != nil {
+				msg.Nack(0)
+			}
+			p.inFlightLimiter.Release()
+			return
+		}
+
+		if decodeErr, ok := err.(*MessageDecodeError); ok {
+			p.handleDecodeError(NewMessage(p.queue, decodeErr.Response), decodeErr)
+			p.inFlightLimiter.Release()
+			failures = 0
+			continue
+		}
+
+		if err != nil {
+			p.inFlightLimiter.Release()
+			failures++
+
+			if !ERR_MQS_NO_MESSAGE.IsEqual(err) {
+				p.onError(nil, err)
+			}
+
+			timer := time.NewTimer(DefaultPollBackoff.Delay(failures))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			continue
+		}
+
+		failures = 0
+
+		if p.keeper != nil {
+			msg.KeepAlive(context.Background(), p.keeper)
+		}
+
+		select {
+		case p.laneOf(msg) <- msg:
+		case <-ctx.Done():
+			msg.Nack(0)
+			p.inFlightLimiter.Release()
+			return
+		}
+	}
+}
+
+func (p *Consumer) laneOf(msg *Message) chan *Message {
+	if len(p.lanes) == 1 {
+		return p.lanes[0]
+	}
+
+	key := p.options.PartitionKey(msg)
+	if key == "" {
+		return p.lanes[0]
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+
+	return p.lanes[hash.Sum32()%uint32(len(p.lanes))]
+}
+
+func (p *Consumer) work(lane chan *Message, stopChan chan bool) {
+	defer p.workerGroup.Done()
+
+	// the keys of the lane held by a nacked message, with its id
+	held := map[string]string{}
+
+	for {
+		select {
+		case <-stopChan:
+			return
+		case msg, ok := <-lane:
+			if !ok {
+				return
+			}
+			if p.options.PartitionKey != nil {
+				p.handleOrdered(msg, held)
+			} else {
+				p.handle(msg)
+			}
+			p.inFlightLimiter.Release()
+		}
+	}
+}
+
+func (p *Consumer) handle(msg *Message) {
+	ctx := context.Background()
+	if p.keeper != nil {
+		ctx = msg.KeepAlive(ctx, p.keeper)
+	}
+
+	err := p.process(ctx, msg)
+
+	if msg.Settled() {
+		return
+	}
+
+	if err != nil {
+		p.onError(msg, err)
+		p.nack(msg)
+		return
+	}
+
+	p.ack(msg)
+}
+
+// handleOrdered retries a failed message in place, so the messages of its
+// key behind it wait. Once a message is given up on, the messages of its key
+// are nacked until it is received again.
+func (p *Consumer) handleOrdered(msg *Message, held map[string]string) {
+	key := p.options.PartitionKey(msg)
+	if key == "" {
+		p.handle(msg)
+		return
+	}
+
+	if id, exist := held[key]; exist {
+		if id != msg.MessageId {
+			p.nack(msg)
+			return
+		}
+		delete(held, key)
+	}
+
+	ctx := msg.KeepAlive(context.Background(), p.keeper)
+
+	for attempt := int64(1); ; attempt++ {
+		err := p.process(ctx, msg)
+
+		if msg.Settled() {
+			return
+		}
+
+		if err == nil {
+			p.ack(msg)
+			return
+		}
+
+		p.onError(msg, err)
+
+		timer := time.NewTimer(msg.backoff.Delay(attempt))
+		select {
+		case <-timer.C:
+			continue
+		case <-ctx.Done():
+		case <-p.ctx.Done():
+		}
+		timer.Stop()
+
+		held[key] = msg.MessageId
+		p.nack(msg)
+
+		return
+	}
+}
+
+func (p *Consumer) handleDecodeError(msg *Message, decodeErr *MessageDecodeError) {
+	p.onError(msg, decodeErr)
+
+	var err error
+	if p.options.OnDecodeError != nil {
+		err = p.options.OnDecodeError(msg, decodeErr)
+	} else if !ERR_MQS_MESSAGE_TAMPERED.IsEqual(decodeErr.Cause) {
+		err = decodeErr
+	}
+
+	if msg.Settled() {
+		return
+	}
+
+	if err != nil {
+		p.nack(msg)
+		return
+	}
+
+	p.ack(msg)
+}
+
+func (p *Consumer) process(ctx context.Context, msg *Message) (err error) {
+	start := time.Now()
+	err = p.call(ctx, msg)
+	p.observeLatency(time.Since(start))
+	return
+}
+
+func (p *Consumer) ack(msg *Message) {
+	if e := msg.Ack(); e != nil {
+		p.onError(msg, e)
+	}
+}
+
+func (p *Consumer) nack(msg *Message) {
+	if e := msg.Nack(); e != nil {
+		p.onError(msg, e)
+	}
+}
+
+func (p *Consumer) call(ctx context.Context, msg *Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = ERR_MQS_HANDLER_PANIC.New(errors.Params{"id": msg.MessageId, "err": r})
+		}
+	}()
+
+	return p.handler(ctx, msg)
+}
+
+func (p *Consumer) observeLatency(latency time.Duration) {
+	for {
+		old := atomic.LoadInt64(&p.latencyNanos)
+		avg := int64(latency)
+		if old > 0 {
+			avg = old + (int64(latency)-old)/5
+		}
+		if atomic.CompareAndSwapInt64(&p.latencyNanos, old, avg) {
+			return
+		}
+	}
+}
+
+func (p *Consumer) onError(msg *Message, err error) {
+	if p.options.OnError != nil {
+		p.options.OnError(msg, err)
+	}
+}
@@ -0,0 +1,173 @@
+package ali_mqs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memQueue serves msgs in order to Receive and records the receipt handles
+// deleted and changed, a changed handle is renewed by appending a quote.
+type memQueue struct {
+	locker  sync.Mutex
+	msgs    []MessageReceiveResponse
+	deleted []string
+	changed []string
+
+	changeErr error
+	backoff   Backoff
+}
+
+func (p *memQueue) Name() string {
+	return "mem"
+}
+
+func (p *memQueue) SendMessage(message MessageSendRequest) (resp MessageSendResponse, err error) {
+	return
+}
+
+func (p *memQueue) ReceiveMessage(respChan chan MessageReceiveResponse, errChan chan error, waitseconds ...int64) {
+}
+
+func (p *memQueue) PeekMessage(respChan chan MessageReceiveResponse, errChan chan error) {
+}
+
+func (p *memQueue) Receive(ctx context.Context, waitseconds ...int64) (msg *Message, err error) {
+	p.locker.Lock()
+	if len(p.msgs) == 0 {
+		p.locker.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Millisecond * 10):
+		}
+		return nil, ERR_MQS_NO_MESSAGE.New()
+	}
+
+	resp := p.msgs[0]
+	p.msgs = p.msgs[1:]
+	p.locker.Unlock()
+
+	if resp.NextVisibleTime == 0 {
+		resp.NextVisibleTime = time.Now().Add(time.Minute).UnixNano() / int64(time.Millisecond)
+	}
+
+	return NewMessage(p, resp, p.backoff), nil
+}
+
+func (p *memQueue) Peek(ctx context.Context) (msg *Message, err error) {
+	return nil, ERR_MQS_NO_MESSAGE.New()
+}
+
+func (p *memQueue) DeleteMessage(receiptHandle string) (err error) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.deleted = append(p.deleted, receiptHandle)
+
+	return
+}
+
+func (p *memQueue) ChangeMessageVisibility(receiptHandle string, visibilityTimeout int64) (resp MessageVisibilityChangeResponse, err error) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if p.changeErr != nil {
+		err = p.changeErr
+		return
+	}
+
+	p.changed = append(p.changed, receiptHandle)
+
+	resp.ReceiptHandle = receiptHandle + "'"
+	resp.NextVisibleTime = time.Now().Add(time.Duration(visibilityTimeout)*time.Second).UnixNano() / int64(time.Millisecond)
+
+	return
+}
+
+func (p *memQueue) Stop() {
+}
+
+func (p *memQueue) Deleted() []string {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return append([]string(nil), p.deleted...)
+}
+
+func (p *memQueue) Changed() []string {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return append([]string(nil), p.changed...)
+}
+
+func waitDeleted(t *testing.T, queue *memQueue, count int) {
+	deadline := time.Now().Add(time.Second * 5)
+	for len(queue.Deleted()) < count && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	if deleted := queue.Deleted(); len(deleted) != count {
+		t.Fatalf("deleted %d of %d messages", len(deleted), count)
+	}
+}
+
+func TestConsumerOrdered(t *testing.T) {
+	queue := &memQueue{backoff: ExponentialBackoff{Initial: time.Millisecond}}
+	for i := 0; i < 30; i++ {
+		queue.msgs = append(queue.msgs, MessageReceiveResponse{
+			MessageId:     fmt.Sprint(i),
+			ReceiptHandle: fmt.Sprint("handle-", i),
+			MessageBody:   []byte(fmt.Sprintf(`{"key":"k%d","seq":%d}`, i%3, i)),
+		})
+	}
+
+	var locker sync.Mutex
+	handled := map[string][]string{}
+	failures := map[string]int{"0": 2, "4": 1}
+
+	consumer := NewConsumer(queue, func(ctx context.Context, msg *Message) error {
+		locker.Lock()
+		defer locker.Unlock()
+
+		if failures[msg.MessageId] > 0 {
+			failures[msg.MessageId]--
+			return errors.New("failed")
+		}
+
+		key := PartitionByJSONField("key")(msg)
+		handled[key] = append(handled[key], msg.MessageId)
+
+		return nil
+	}, ConsumerOptions{Pollers: 4, Workers: 3, PartitionKey: PartitionByJSONField("key")})
+
+	consumer.Start()
+	consumer.SetPollers(4)
+
+	if consumer.Pollers() != 1 {
+		t.Fatalf("ordered consumer has %d pollers", consumer.Pollers())
+	}
+
+	waitDeleted(t, queue, 30)
+	consumer.Stop()
+
+	locker.Lock()
+	defer locker.Unlock()
+
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprint("k", i)
+
+		var expected []string
+		for j := i; j < 30; j += 3 {
+			expected = append(expected, fmt.Sprint(j))
+		}
+
+		if fmt.Sprint(handled[key]) != fmt.Sprint(expected) {
+			t.Fatalf("%s handled %v, expected %v", key, handled[key], expected)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package ali_mqs
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gogap/errors"
+)
+
+const (
+	bodyHeaderDeadLetter = "dl"
+
+	// the last error is cut so the header stays small next to the body
+	maxDeadLetterErrorLength = 128
+
+	DefaultMaxDequeueCount int64 = 16
+)
+
+type MessageHandler func(ctx context.Context, msg *Message) error
+
+type MessageMiddleware func(next MessageHandler) MessageHandler
+
+// DeadLetterMessage is a message routed by DeadLetterRouter. Truncated is
+// set if the body did not fit into the dead letter queue and no blob store was
+// set, MessageBody then holds the first part of the BodySize bytes.
+type DeadLetterMessage struct {
+	SourceQueue      string      `json:"source_queue"`
+	MessageId        string      `json:"message_id"`
+	EnqueueTime      int64       `json:"enqueue_time"`
+	FirstDequeueTime int64       `json:"first_dequeue_time"`
+	DequeueCount     int64       `json:"dequeue_count"`
+	Priority         int64       `json:"priority"`
+	DeadLetterTime   int64       `json:"dead_letter_time"`
+	LastError        string      `json:"last_error,omitempty"`
+	Truncated        bool        `json:"truncated,omitempty"`
+	BodySize         int64       `json:"body_size"`
+	MessageBody      Base64Bytes `json:"message_body"`
+}
+
+type DeadLetterRouter struct {
+	queue           AliMQSQueue
+	maxDequeueCount int64
+	store           BlobStore
+}
+
+type messageSizer interface {
+	maxMessageSize() int32
+}
+
+func NewDeadLetterRouter(deadLetterQueue AliMQSQueue, maxDequeueCount int64) *DeadLetterRouter {
+	if deadLetterQueue == nil {
+		panic("ali_mqs: dead letter queue could not be nil")
+	}
+
+	if maxDequeueCount <= 0 {
+		maxDequeueCount = DefaultMaxDequeueCount
+	}
+
+	return &DeadLetterRouter{
+		queue:           deadLetterQueue,
+		maxDequeueCount: maxDequeueCount,
+	}
+}
+
+func (p *DeadLetterRouter) Queue() AliMQSQueue {
+	return p.queue
+}
+
+func (p *DeadLetterRouter) MaxDequeueCount() int64 {
+	return p.maxDequeueCount
+}
+
+// SetBlobStore makes bodies too large for the dead letter queue go to store,
+// the dead letter then carries a claim check reference which a queue with a
+// ClaimCheckFilter on the same store resolves once redriven. Without a blob
+// store such bodies are truncated.
+func (p *DeadLetterRouter) SetBlobStore(store BlobStore) {
+	p.store = store
+}
+
+// Middleware routes messages dequeued more than the max dequeue count without
+// calling next, and routes the message on its last attempt if next fails.
+func (p *DeadLetterRouter) Middleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg *Message) (err error) {
+		if msg.DequeueCount > p.maxDequeueCount {
+			return p.Route(msg, ERR_MQS_DEQUEUE_COUNT_EXCEEDED.New(errors.Params{"count": msg.DequeueCount, "max": p.maxDequeueCount}))
+		}
+
+		if err = next(ctx, msg); err != nil && msg.DequeueCount >= p.maxDequeueCount {
+			return p.Route(msg, err)
+		}
+
+		return
+	}
+}
+
+// Route sends msg to the dead letter queue and deletes the original only
+// after the send succeeded, so a crash in between duplicates but never loses.
+func (p *DeadLetterRouter) Route(msg *Message, lastErr error) (err error) {
+	deadLetter := DeadLetterMessage{
+		MessageId:        msg.MessageId,
+		EnqueueTime:      msg.EnqueueTime,
+		FirstDequeueTime: msg.FirstDequeueTime,
+		DequeueCount:     msg.DequeueCount,
+		Priority:         msg.Priority,
+		DeadLetterTime:   time.Now().UnixNano() / int64(time.Millisecond),
+		BodySize:         int64(len(msg.MessageBody)),
+		MessageBody:      msg.MessageBody,
+	}
+
+	if msg.Queue() != nil {
+		deadLetter.SourceQueue = msg.Queue().Name()
+	}
+
+	if lastErr != nil {
+		deadLetter.LastError = lastErr.Error()
+	}
+
+	var body []byte
+	if body, err = p.encode(deadLetter); err != nil {
+		err = ERR_MQS_SEND_DEAD_LETTER_FAILED.New(errors.Params{"id": msg.MessageId, "queue": p.queue.Name(), "err": err})
+		return
+	}
+
+	if _, err = p.queue.SendMessage(MessageSendRequest{
+		MessageBody: body,
+		Priority:    msg.Priority,
+	}); err != nil {
+		err = ERR_MQS_SEND_DEAD_LETTER_FAILED.New(errors.Params{"id": msg.MessageId, "queue": p.queue.Name(), "err": err})
+		return
+	}
+
+	err = msg.Ack()
+
+	return
+}
+
+// encode fits the dead letter into the max message size of the dead letter
+// queue, moving the body to the blob store or truncating it if needed.
+func (p *DeadLetterRouter) encode(deadLetter DeadLetterMessage) (body []byte, err error) {
+	maxSize := MaxMessageSize
+	if sizer, ok := p.queue.(messageSizer); ok {
+		maxSize = sizer.maxMessageSize()
+	}
+
+	// bodies are base64 encoded on the wire
+	limit := int(maxSize) / 4 * 3
+
+	if body = encodeDeadLetter(deadLetter); len(body) <= limit {
+		return
+	}
+
+	if p.store != nil {
+		var key string
+		if key, err = p.store.Put(deadLetter.MessageBody); err != nil {
+			err = ERR_MQS_BLOB_STORE_FAILED.New(errors.Params{"op": "put", "key": "", "err": err})
+			return
+		}
+		deadLetter.MessageBody = encodeBodyHeader(bodyHeaderBlobRef, key, nil)
+		return encodeDeadLetter(deadLetter), nil
+	}
+
+	original := deadLetter.MessageBody
+
+	deadLetter.Truncated = true
+	deadLetter.MessageBody = nil
+
+	size := limit - len(encodeDeadLetter(deadLetter))
+	if size < 0 {
+		size = 0
+	}
+	deadLetter.MessageBody = original[:size]
+
+	return encodeDeadLetter(deadLetter), nil
+}
+
+// encodeDeadLetter keeps the body raw behind a one line header, so the body
+// is not base64 encoded twice and a dead letter is barely larger than the
+// message it carries.
+func encodeDeadLetter(deadLetter DeadLetterMessage) []byte {
+	lastError := deadLetter.LastError
+	if len(lastError) > maxDeadLetterErrorLength {
+		lastError = lastError[:maxDeadLetterErrorLength]
+	}
+
+	values := url.Values{}
+	values.Set("src", deadLetter.SourceQueue)
+	values.Set("id", deadLetter.MessageId)
+	values.Set("enq", strconv.FormatInt(deadLetter.EnqueueTime, 10))
+	values.Set("fdq", strconv.FormatInt(deadLetter.FirstDequeueTime, 10))
+	values.Set("dc", strconv.FormatInt(deadLetter.DequeueCount, 10))
+	values.Set("pri", strconv.FormatInt(deadLetter.Priority, 10))
+	values.Set("at", strconv.FormatInt(deadLetter.DeadLetterTime, 10))
+	values.Set("size", strconv.FormatInt(deadLetter.BodySize, 10))
+	if deadLetter.Truncated {
+		values.Set("trunc", "1")
+	}
+	if lastError != "" {
+		values.Set("err", lastError)
+	}
+
+	return encodeBodyHeader(bodyHeaderDeadLetter, values.Encode(), deadLetter.MessageBody)
+}
+
+func ParseDeadLetterMessage(body []byte) (deadLetter DeadLetterMessage, err error) {
+	header, payload, ok := decodeBodyHeader(body, bodyHeaderDeadLetter)
+	if !ok {
+		err = ERR_UNMARSHAL_DEAD_LETTER_FAILED.New(errors.Params{"err": "no dead letter header"})
+		return
+	}
+
+	var values url.Values
+	if values, err = url.ParseQuery(header); err != nil {
+		err = ERR_UNMARSHAL_DEAD_LETTER_FAILED.New(errors.Params{"err": err})
+		return
+	}
+
+	deadLetter = DeadLetterMessage{
+		SourceQueue: values.Get("src"),
+		MessageId:   values.Get("id"),
+		LastError:   values.Get("err"),
+		Truncated:   values.Get("trunc") == "1",
+		MessageBody: payload,
+	}
+
+	for _, field := range []struct {
+		key   string
+		value *int64
+	}{
+		{"enq", &deadLetter.EnqueueTime},
+		{"fdq", &deadLetter.FirstDequeueTime},
+		{"dc", &deadLetter.DequeueCount},
+		{"pri", &deadLetter.Priority},
+		{"at", &deadLetter.DeadLetterTime},
+		{"size", &deadLetter.BodySize},
+	} {
+		if *field.value, err = strconv.ParseInt(values.Get(field.key), 10, 64); err != nil {
+			err = ERR_UNMARSHAL_DEAD_LETTER_FAILED.New(errors.Params{"err": err})
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,108 @@
+package ali_mqs
+
+import (
+	"context"
+	"time"
+
+	"github.com/gogap/errors"
+)
+
+const (
+	DefaultDedupWindow            = time.Hour * 24
+	DefaultDedupProcessingTimeout = time.Minute * 5
+)
+
+type DedupStatus int
+
+const (
+	DedupNew DedupStatus = iota
+	DedupProcessing
+	DedupDone
+)
+
+type DedupStore interface {
+	// Begin marks key as processing for ttl if it is unknown or expired, and
+	// returns the status the key had before.
+	Begin(key string, ttl time.Duration) (status DedupStatus, err error)
+	Commit(key string, ttl time.Duration) (err error)
+	Abort(key string) (err error)
+}
+
+type DedupKeyFunc func(msg *Message) string
+
+func DedupByMessageId(msg *Message) string {
+	return msg.MessageId
+}
+
+func DedupByBodyMD5(msg *Message) string {
+	return msg.MessageBodyMD5
+}
+
+type Deduplicator struct {
+	store             DedupStore
+	keyFunc           DedupKeyFunc
+	window            time.Duration
+	processingTimeout time.Duration
+}
+
+func NewDeduplicator(store DedupStore, window time.Duration, keyFunc ...DedupKeyFunc) *Deduplicator {
+	if store == nil {
+		panic("ali_mqs: dedup store could not be nil")
+	}
+
+	if window <= 0 {
+		window = DefaultDedupWindow
+	}
+
+	deduplicator := &Deduplicator{
+		store:             store,
+		keyFunc:           DedupByMessageId,
+		window:            window,
+		processingTimeout: DefaultDedupProcessingTimeout,
+	}
+
+	if len(keyFunc) > 0 && keyFunc[0] != nil {
+		deduplicator.keyFunc = keyFunc[0]
+	}
+
+	return deduplicator
+}
+
+func (p *Deduplicator) SetProcessingTimeout(timeout time.Duration) {
+	p.processingTimeout = timeout
+}
+
+// Middleware deletes messages already handled within the window without
+// calling next. A message still being handled elsewhere is failed with
+// ERR_MQS_MESSAGE_IS_PROCESSING so it is redelivered and checked again.
+func (p *Deduplicator) Middleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg *Message) (err error) {
+		key := p.keyFunc(msg)
+		if key == "" {
+			return next(ctx, msg)
+		}
+
+		var status DedupStatus
+		if status, err = p.store.Begin(key, p.processingTimeout); err != nil {
+			err = ERR_MQS_DEDUP_STORE_FAILED.New(errors.Params{"key": key, "err": err})
+			return
+		}
+
+		switch status {
+		case DedupDone:
+			return msg.Ack()
+		case DedupProcessing:
+			return ERR_MQS_MESSAGE_IS_PROCESSING.New(errors.Params{"key": key})
+		}
+
+		if err = next(ctx, msg); err != nil {
+			p.store.Abort(key)
+			return
+		}
+
+		// the message is handled, failing it now would only process it twice
+		p.store.Commit(key, p.window)
+
+		return
+	}
+}
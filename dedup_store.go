@@ -0,0 +1,275 @@
+package ali_mqs
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogap/errors"
+)
+
+const (
+	DefaultDedupCapacity = 100000
+)
+
+type dedupEntry struct {
+	key      string
+	status   DedupStatus
+	expireAt time.Time
+}
+
+type MemoryDedupStore struct {
+	locker   sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+func NewMemoryDedupStore(capacity int) *MemoryDedupStore {
+	if capacity <= 0 {
+		capacity = DefaultDedupCapacity
+	}
+
+	return &MemoryDedupStore{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (p *MemoryDedupStore) Begin(key string, ttl time.Duration) (status DedupStatus, err error) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if entry, exist := p.get(key); exist {
+		return entry.status, nil
+	}
+
+	p.set(key, DedupProcessing, time.Now().Add(ttl))
+
+	return DedupNew, nil
+}
+
+func (p *MemoryDedupStore) Commit(key string, ttl time.Duration) (err error) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.set(key, DedupDone, time.Now().Add(ttl))
+
+	return
+}
+
+func (p *MemoryDedupStore) Abort(key string) (err error) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if elem, exist := p.entries[key]; exist {
+		p.remove(elem)
+	}
+
+	return
+}
+
+func (p *MemoryDedupStore) Len() int {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return p.lru.Len()
+}
+
+func (p *MemoryDedupStore) get(key string) (entry *dedupEntry, exist bool) {
+	var elem *list.Element
+	if elem, exist = p.entries[key]; !exist {
+		return
+	}
+
+	entry = elem.Value.(*dedupEntry)
+	if time.Now().After(entry.expireAt) {
+		p.remove(elem)
+		return nil, false
+	}
+
+	p.lru.MoveToFront(elem)
+
+	return
+}
+
+func (p *MemoryDedupStore) set(key string, status DedupStatus, expireAt time.Time) {
+	if elem, exist := p.entries[key]; exist {
+		entry := elem.Value.(*dedupEntry)
+		entry.status = status
+		entry.expireAt = expireAt
+		p.lru.MoveToFront(elem)
+		return
+	}
+
+	p.entries[key] = p.lru.PushFront(&dedupEntry{key: key, status: status, expireAt: expireAt})
+
+	for p.lru.Len() > p.capacity {
+		p.remove(p.lru.Back())
+	}
+}
+
+func (p *MemoryDedupStore) remove(elem *list.Element) {
+	p.lru.Remove(elem)
+	delete(p.entries, elem.Value.(*dedupEntry).key)
+}
+
+// FileDedupStore keeps processing keys in memory and appends committed keys
+// to a log file, which is replayed on open and compacted as it grows.
+type FileDedupStore struct {
+	*MemoryDedupStore
+
+	fileLocker sync.Mutex
+	filename   string
+	file       *os.File
+	records    int
+}
+
+func NewFileDedupStore(filename string, capacity int) (store *FileDedupStore, err error) {
+	store = &FileDedupStore{
+		MemoryDedupStore: NewMemoryDedupStore(capacity),
+		filename:         filename,
+	}
+
+	if err = store.load(); err != nil {
+		return nil, err
+	}
+
+	if err = store.compact(); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+func (p *FileDedupStore) Commit(key string, ttl time.Duration) (err error) {
+	expireAt := time.Now().Add(ttl)
+
+	p.MemoryDedupStore.locker.Lock()
+	p.MemoryDedupStore.set(key, DedupDone, expireAt)
+	p.MemoryDedupStore.locker.Unlock()
+
+	p.fileLocker.Lock()
+	defer p.fileLocker.Unlock()
+
+	if _, err = fmt.Fprintf(p.file, "%s %d\n", strconv.Quote(key), expireAt.UnixNano()); err != nil {
+		err = ERR_MQS_DEDUP_STORE_FAILED.New(errors.Params{"key": key, "err": err})
+		return
+	}
+
+	p.records++
+
+	if p.records > p.Len()*2+p.capacity {
+		err = p.compactLocked()
+	}
+
+	return
+}
+
+func (p *FileDedupStore) Close() (err error) {
+	p.fileLocker.Lock()
+	defer p.fileLocker.Unlock()
+
+	return p.file.Close()
+}
+
+func (p *FileDedupStore) load() (err error) {
+	var file *os.File
+	if file, err = os.Open(p.filename); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return
+	}
+	defer file.Close()
+
+	now := time.Now()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		idx := strings.LastIndex(line, " ")
+		if idx < 0 {
+			continue
+		}
+
+		key, e := strconv.Unquote(line[:idx])
+		if e != nil {
+			continue
+		}
+
+		expireAt, e := strconv.ParseInt(line[idx+1:], 10, 64)
+		if e != nil || time.Unix(0, expireAt).Before(now) {
+			continue
+		}
+
+		p.MemoryDedupStore.set(key, DedupDone, time.Unix(0, expireAt))
+	}
+
+	return scanner.Err()
+}
+
+func (p *FileDedupStore) compact() (err error) {
+	p.fileLocker.Lock()
+	defer p.fileLocker.Unlock()
+
+	return p.compactLocked()
+}
+
+func (p *FileDedupStore) compactLocked() (err error) {
+	tmpFilename := p.filename + ".tmp"
+
+	var tmpFile *os.File
+	if tmpFile, err = os.OpenFile(tmpFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644); err != nil {
+		return
+	}
+
+	writer := bufio.NewWriter(tmpFile)
+	records := 0
+	now := time.Now()
+
+	p.MemoryDedupStore.locker.Lock()
+	for elem := p.lru.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*dedupEntry)
+		if entry.status != DedupDone || entry.expireAt.Before(now) {
+			continue
+		}
+		fmt.Fprintf(writer, "%s %d\n", strconv.Quote(entry.key), entry.expireAt.UnixNano())
+		records++
+	}
+	p.MemoryDedupStore.locker.Unlock()
+
+	if err = writer.Flush(); err == nil {
+		err = tmpFile.Sync()
+	}
+
+	if e := tmpFile.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		return
+	}
+
+	if err = os.Rename(tmpFilename, p.filename); err != nil {
+		return
+	}
+
+	if p.file != nil {
+		p.file.Close()
+	}
+
+	if p.file, err = os.OpenFile(p.filename, os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+		return
+	}
+
+	p.records = records
+
+	return
+}
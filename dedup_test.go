@@ -0,0 +1,122 @@
+package ali_mqs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeduplicator(t *testing.T) {
+	queue := &memQueue{}
+	store := NewMemoryDedupStore(0)
+
+	handled := map[string]int{}
+	failing := true
+
+	handler := NewDeduplicator(store, time.Minute).Middleware(func(ctx context.Context, msg *Message) error {
+		if msg.MessageId == "b" && failing {
+			failing = false
+			return errors.New("failed")
+		}
+		handled[msg.MessageId]++
+		return nil
+	})
+
+	deliver := func(id, receiptHandle string) error {
+		return handler(context.Background(), NewMessage(queue, MessageReceiveResponse{MessageId: id, ReceiptHandle: receiptHandle}))
+	}
+
+	if err := deliver("a", "a1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a duplicate is deleted without being handled
+	if err := deliver("a", "a2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if handled["a"] != 1 {
+		t.Fatalf("a handled %d times", handled["a"])
+	}
+
+	if deleted := queue.Deleted(); len(deleted) != 1 || deleted[0] != "a2" {
+		t.Fatalf("deleted %v", deleted)
+	}
+
+	// a failed message is handled again when it is redelivered
+	if err := deliver("b", "b1"); err == nil {
+		t.Fatal("b did not fail")
+	}
+
+	if err := deliver("b", "b2"); err != nil || handled["b"] != 1 {
+		t.Fatalf("b handled %d times, err %v", handled["b"], err)
+	}
+
+	// a message being handled elsewhere is left to be redelivered
+	if _, err := store.Begin("c", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := deliver("c", "c1"); !ERR_MQS_MESSAGE_IS_PROCESSING.IsEqual(err) {
+		t.Fatalf("c: %v", err)
+	}
+
+	if handled["c"] != 0 {
+		t.Fatal("c handled while processing elsewhere")
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	store := NewMemoryDedupStore(0)
+
+	if err := store.Commit("a", time.Millisecond*10); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, _ := store.Begin("a", time.Minute); status != DedupDone {
+		t.Fatalf("status %d within the window", status)
+	}
+
+	time.Sleep(time.Millisecond * 20)
+
+	if status, _ := store.Begin("a", time.Minute); status != DedupNew {
+		t.Fatalf("status %d after the window", status)
+	}
+}
+
+func TestFileDedupStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "dedup.log")
+
+	store, err := NewFileDedupStore(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = store.Begin("processing", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.Commit("done", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// only committed keys survive a restart
+	if store, err = NewFileDedupStore(filename, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if status, _ := store.Begin("done", time.Minute); status != DedupDone {
+		t.Fatalf("done has status %d", status)
+	}
+
+	if status, _ := store.Begin("processing", time.Minute); status != DedupNew {
+		t.Fatalf("processing has status %d", status)
+	}
+}
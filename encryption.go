@@ -0,0 +1,207 @@
+package ali_mqs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"strings"
+	"sync"
+
+	"github.com/gogap/errors"
+)
+
+const (
+	bodyHeaderEncryption = "enc"
+
+	dataKeySize = 32
+)
+
+// KeyProvider generates data keys wrapped by a master key and unwraps them
+// again by the id of the master key, which is kept in the envelope so keys
+// can be rotated while old messages are still readable.
+type KeyProvider interface {
+	GenerateDataKey() (keyId string, dataKey []byte, wrappedKey []byte, err error)
+	DecryptDataKey(keyId string, wrappedKey []byte) (dataKey []byte, err error)
+}
+
+// StaticKeyProvider wraps data keys with AES-GCM master keys held in memory.
+type StaticKeyProvider struct {
+	locker       sync.RWMutex
+	currentKeyId string
+	masterKeys   map[string][]byte
+}
+
+func NewStaticKeyProvider() *StaticKeyProvider {
+	return &StaticKeyProvider{
+		masterKeys: make(map[string][]byte),
+	}
+}
+
+// AddMasterKey adds a 16, 24 or 32 bytes master key, the last key added with
+// current set is used to wrap new data keys.
+func (p *StaticKeyProvider) AddMasterKey(keyId string, masterKey []byte, current bool) (err error) {
+	if keyId == "" || strings.ContainsAny(keyId, "\n:") {
+		err = ERR_MQS_INVALID_KEY_ID.New(errors.Params{"key_id": keyId})
+		return
+	}
+
+	if _, err = aes.NewCipher(masterKey); err != nil {
+		return
+	}
+
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.masterKeys[keyId] = masterKey
+	if current || p.currentKeyId == "" {
+		p.currentKeyId = keyId
+	}
+
+	return
+}
+
+func (p *StaticKeyProvider) GenerateDataKey() (keyId string, dataKey []byte, wrappedKey []byte, err error) {
+	p.locker.RLock()
+	keyId = p.currentKeyId
+	masterKey := p.masterKeys[keyId]
+	p.locker.RUnlock()
+
+	if masterKey == nil {
+		err = ERR_MQS_KEY_NOT_FOUND.New(errors.Params{"key_id": keyId})
+		return
+	}
+
+	dataKey = make([]byte, dataKeySize)
+	if _, err = rand.Read(dataKey); err != nil {
+		return
+	}
+
+	wrappedKey, err = sealGCM(masterKey, dataKey, []byte(keyId))
+
+	return
+}
+
+func (p *StaticKeyProvider) DecryptDataKey(keyId string, wrappedKey []byte) (dataKey []byte, err error) {
+	p.locker.RLock()
+	masterKey := p.masterKeys[keyId]
+	p.locker.RUnlock()
+
+	if masterKey == nil {
+		err = ERR_MQS_KEY_NOT_FOUND.New(errors.Params{"key_id": keyId})
+		return
+	}
+
+	return openGCM(masterKey, wrappedKey, []byte(keyId))
+}
+
+// EncryptionFilter encrypts bodies with a fresh AES-GCM data key per message.
+// The envelope is the key id header, the wrapped data key length and the
+// wrapped data key, followed by the nonce and the sealed body, with the key id
+// and wrapped key authenticated too.
+type EncryptionFilter struct {
+	provider       KeyProvider
+	allowPlaintext bool
+}
+
+func NewEncryptionFilter(provider KeyProvider) *EncryptionFilter {
+	if provider == nil {
+		panic("ali_mqs: encryption key provider could not be nil")
+	}
+
+	return &EncryptionFilter{provider: provider}
+}
+
+// SetAllowPlaintext lets bodies without an envelope through, for queues which
+// still hold messages sent before encryption was enabled.
+func (p *EncryptionFilter) SetAllowPlaintext(allow bool) {
+	p.allowPlaintext = allow
+}
+
+func (p *EncryptionFilter) EncodeBody(body []byte) (encoded []byte, err error) {
+	var keyId string
+	var dataKey, wrappedKey []byte
+	if keyId, dataKey, wrappedKey, err = p.provider.GenerateDataKey(); err != nil {
+		return
+	}
+
+	envelope := make([]byte, 2, 2+len(wrappedKey))
+	binary.BigEndian.PutUint16(envelope, uint16(len(wrappedKey)))
+	envelope = append(envelope, wrappedKey...)
+
+	var sealed []byte
+	if sealed, err = sealGCM(dataKey, body, append([]byte(keyId), envelope...)); err != nil {
+		return
+	}
+
+	return encodeBodyHeader(bodyHeaderEncryption, keyId, append(envelope, sealed...)), nil
+}
+
+func (p *EncryptionFilter) DecodeBody(body []byte) (decoded []byte, err error) {
+	keyId, payload, ok := decodeBodyHeader(body, bodyHeaderEncryption)
+	if !ok {
+		if p.allowPlaintext {
+			return body, nil
+		}
+		err = ERR_MQS_MESSAGE_NOT_ENCRYPTED.New()
+		return
+	}
+
+	if len(payload) < 2 || len(payload) < 2+int(binary.BigEndian.Uint16(payload)) {
+		err = ERR_MQS_MESSAGE_TAMPERED.New(errors.Params{"key_id": keyId, "err": "envelope too short"})
+		return
+	}
+
+	wrappedKeyEnd := 2 + int(binary.BigEndian.Uint16(payload))
+	envelope, sealed := payload[:wrappedKeyEnd], payload[wrappedKeyEnd:]
+
+	var dataKey []byte
+	if dataKey, err = p.provider.DecryptDataKey(keyId, envelope[2:]); err != nil {
+		err = ERR_MQS_MESSAGE_TAMPERED.New(errors.Params{"key_id": keyId, "err": err})
+		return
+	}
+
+	if decoded, err = openGCM(dataKey, sealed, append([]byte(keyId), envelope...)); err != nil {
+		err = ERR_MQS_MESSAGE_TAMPERED.New(errors.Params{"key_id": keyId, "err": err})
+		return
+	}
+
+	return
+}
+
+func sealGCM(key, plaintext, additionalData []byte) (sealed []byte, err error) {
+	var gcm cipher.AEAD
+	if gcm, err = newGCM(key); err != nil {
+		return
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openGCM(key, sealed, additionalData []byte) (plaintext []byte, err error) {
+	var gcm cipher.AEAD
+	if gcm, err = newGCM(key); err != nil {
+		return
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		err = ERR_MQS_MESSAGE_TAMPERED.New(errors.Params{"key_id": "", "err": "sealed data too short"})
+		return
+	}
+
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additionalData)
+}
+
+func newGCM(key []byte) (gcm cipher.AEAD, err error) {
+	var block cipher.Block
+	if block, err = aes.NewCipher(key); err != nil {
+		return
+	}
+
+	return cipher.NewGCM(block)
+}
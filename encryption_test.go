@@ -0,0 +1,93 @@
+package ali_mqs
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newTestKeyProvider(t *testing.T, keyIds ...string) *StaticKeyProvider {
+	provider := NewStaticKeyProvider()
+	for i, keyId := range keyIds {
+		if err := provider.AddMasterKey(keyId, bytes.Repeat([]byte{byte(i + 1)}, 32), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return provider
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	provider := newTestKeyProvider(t, "old")
+	filter := NewEncryptionFilter(provider)
+
+	body := []byte("hello world")
+
+	oldEncoded, err := filter.EncodeBody(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(oldEncoded, body) {
+		t.Fatal("body is not encrypted")
+	}
+
+	// messages sealed under a rotated key stay readable
+	if err = provider.AddMasterKey("new", bytes.Repeat([]byte{9}, 32), true); err != nil {
+		t.Fatal(err)
+	}
+
+	newEncoded, err := filter.EncodeBody(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, encoded := range [][]byte{oldEncoded, newEncoded} {
+		decoded, err := filter.DecodeBody(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(decoded, body) {
+			t.Fatalf("decoded %q", decoded)
+		}
+	}
+}
+
+func TestEncryptionTampered(t *testing.T) {
+	filter := NewEncryptionFilter(newTestKeyProvider(t, "key"))
+
+	encoded, err := filter.EncodeBody([]byte("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range encoded {
+		tampered := append([]byte(nil), encoded...)
+		tampered[i] ^= 0x01
+
+		if _, err = filter.DecodeBody(tampered); err == nil {
+			t.Fatalf("byte %d flipped but decoded", i)
+		}
+	}
+
+	if _, err = filter.DecodeBody(encoded[:len(encoded)-1]); !ERR_MQS_MESSAGE_TAMPERED.IsEqual(err) {
+		t.Fatalf("truncated body: %v", err)
+	}
+
+	if _, err = NewEncryptionFilter(newTestKeyProvider(t, "other")).DecodeBody(encoded); !ERR_MQS_MESSAGE_TAMPERED.IsEqual(err) {
+		t.Fatalf("unknown key: %v", err)
+	}
+}
+
+func TestEncryptionPlaintext(t *testing.T) {
+	filter := NewEncryptionFilter(newTestKeyProvider(t, "key"))
+
+	if _, err := filter.DecodeBody([]byte("plain")); !ERR_MQS_MESSAGE_NOT_ENCRYPTED.IsEqual(err) {
+		t.Fatalf("plaintext: %v", err)
+	}
+
+	filter.SetAllowPlaintext(true)
+
+	if decoded, err := filter.DecodeBody([]byte("plain")); err != nil || string(decoded) != "plain" {
+		t.Fatalf("decoded %q, err %v", decoded, err)
+	}
+}
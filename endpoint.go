@@ -0,0 +1,71 @@
+package ali_mqs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gogap/errors"
+)
+
+const (
+	DefaultEndpointDomain = "aliyuncs.com"
+)
+
+type EndpointResolver interface {
+	Resolve(ownerId string, location MQSLocation) (url string, err error)
+}
+
+type EndpointResolverFunc func(ownerId string, location MQSLocation) (url string, err error)
+
+func (p EndpointResolverFunc) Resolve(ownerId string, location MQSLocation) (url string, err error) {
+	return p(ownerId, location)
+}
+
+// Endpoint resolves the service url of a location. Locations without a
+// country prefix, such as hangzhou, are taken as regions in China. BaseURL,
+// when set, is used for every location, for example to reach an emulator.
+type Endpoint struct {
+	Scheme   string
+	Domain   string
+	Internal bool
+	VPC      bool
+	BaseURL  string
+}
+
+var (
+	DefaultEndpoint EndpointResolver = Endpoint{}
+)
+
+func (p Endpoint) Resolve(ownerId string, location MQSLocation) (url string, err error) {
+	if p.BaseURL != "" {
+		return strings.TrimRight(p.BaseURL, "/"), nil
+	}
+
+	if ownerId == "" || location == "" {
+		err = ERR_MQS_RESOLVE_ENDPOINT_FAILED.New(errors.Params{"owner_id": ownerId, "location": location})
+		return
+	}
+
+	scheme := p.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	domain := p.Domain
+	if domain == "" {
+		domain = DefaultEndpointDomain
+	}
+
+	region := string(location)
+	if !strings.Contains(region, "-") {
+		region = "cn-" + region
+	}
+
+	if p.VPC {
+		region += "-internal-vpc"
+	} else if p.Internal {
+		region += "-internal"
+	}
+
+	return fmt.Sprintf("%s://%s.mqs-%s.%s", scheme, ownerId, region, domain), nil
+}
@@ -52,11 +52,49 @@ var (
 	ERR_MQS_TIME_EXPIRED                 = errors.TN(ALI_MQS_ERR_NS, 125, ali_MQS_ERR_TEMPSTR)
 
 	ERR_MQS_QUEUE_NAME_IS_TOO_LONG                 = errors.TN(ALI_MQS_ERR_NS, 126, "queue name is too long, the max length is 256")
-	ERR_MQS_DELAY_SECONDS_RANGE_ERROR              = errors.TN(ALI_MQS_ERR_NS, 127, "queue delay seconds is not in range of (0~60480)")
+	ERR_MQS_DELAY_SECONDS_RANGE_ERROR              = errors.TN(ALI_MQS_ERR_NS, 127, "queue delay seconds is not in range of (0~604800)")
 	ERR_MQS_MAX_MESSAGE_SIZE_RANGE_ERROR           = errors.TN(ALI_MQS_ERR_NS, 128, "max message size is not in range of (1024~65536)")
 	ERR_MQS_MSG_RETENTION_PERIOD_RANGE_ERROR       = errors.TN(ALI_MQS_ERR_NS, 129, "message retention period is not in range of (60~129600)")
 	ERR_MQS_MSG_VISIBILITY_TIMEOUT_RANGE_ERROR     = errors.TN(ALI_MQS_ERR_NS, 130, "message visibility timeout is not in range of (1~43200)")
 	ERR_MQS_MSG_POOLLING_WAIT_SECONDS_RANGE_ERROR  = errors.TN(ALI_MQS_ERR_NS, 131, "message poolling wait seconds is not in range of (0~30)")
 	REE_MQS_GET_QUEUE_RET_NUMBER_RANGE_ERROR       = errors.TN(ALI_MQS_ERR_NS, 132, "get queue list param of ret number is not in range of (1~1000)")
 	ERR_MQS_QUEUE_ALREADY_EXIST_AND_HAVE_SAME_ATTR = errors.TN(ALI_MQS_ERR_NS, 133, "mqs queue already exist, and the attribute is the same, queue name: {{.name}}")
+	ERR_MQS_MESSAGE_LEASE_LOST                     = errors.TN(ALI_MQS_ERR_NS, 134, "message lease lost, queue: {{.queue}}, error: {{.err}}")
+	ERR_MQS_MESSAGE_ALREADY_SETTLED                = errors.TN(ALI_MQS_ERR_NS, 135, "message already acked or nacked, message id: {{.id}}")
+	ERR_MQS_DEQUEUE_COUNT_EXCEEDED                 = errors.TN(ALI_MQS_ERR_NS, 136, "message dequeue count {{.count}} exceeded the max dequeue count {{.max}}")
+	ERR_MQS_SEND_DEAD_LETTER_FAILED                = errors.TN(ALI_MQS_ERR_NS, 137, "send message to dead letter queue failed, message id: {{.id}}, queue: {{.queue}}, error: {{.err}}")
+	ERR_UNMARSHAL_DEAD_LETTER_FAILED               = errors.TN(ALI_MQS_ERR_NS, 138, "unmarshal dead letter message failed, {{.err}}")
+	ERR_MQS_REDRIVE_RECEIVE_FAILED                 = errors.TN(ALI_MQS_ERR_NS, 139, "redrive receive message failed, queue: {{.queue}}, error: {{.err}}")
+	ERR_MQS_DEDUP_STORE_FAILED                     = errors.TN(ALI_MQS_ERR_NS, 140, "dedup store failed, key: {{.key}}, error: {{.err}}")
+	ERR_MQS_MESSAGE_IS_PROCESSING                  = errors.TN(ALI_MQS_ERR_NS, 141, "message is being processed by another consumer, key: {{.key}}")
+	ERR_MQS_NO_MESSAGE                             = errors.TN(ALI_MQS_ERR_NS, 142, "no message in queue: {{.queue}}")
+	ERR_MQS_RECEIVER_STOPPED                       = errors.TN(ALI_MQS_ERR_NS, 143, "receiver of queue {{.queue}} is stopped")
+	ERR_MQS_HANDLER_PANIC                          = errors.TN(ALI_MQS_ERR_NS, 144, "message handler panic, message id: {{.id}}, error: {{.err}}")
+	ERR_MQS_PRODUCER_CLOSED                        = errors.TN(ALI_MQS_ERR_NS, 145, "producer of queue {{.queue}} is closed")
+	ERR_MQS_PRODUCER_FLUSH_TIMEOUT                 = errors.TN(ALI_MQS_ERR_NS, 146, "producer of queue {{.queue}} flush timeout after {{.timeout}}")
+	ERR_MQS_MESSAGE_BODY_CORRUPTED                 = errors.TN(ALI_MQS_ERR_NS, 147, "message body md5 mismatch, queue: {{.queue}}, message id: {{.id}}, expected: {{.expected}}, actual: {{.actual}}")
+	ERR_MQS_CODEC_UNSUPPORTED_TYPE                 = errors.TN(ALI_MQS_ERR_NS, 148, "codec {{.content_type}} does not support type {{.type}}")
+	ERR_MQS_CODEC_NOT_REGISTERED                   = errors.TN(ALI_MQS_ERR_NS, 149, "codec of content type {{.content_type}} is not registered")
+	ERR_MQS_CODEC_MARSHAL_FAILED                   = errors.TN(ALI_MQS_ERR_NS, 150, "codec {{.content_type}} marshal failed, {{.err}}")
+	ERR_MQS_CODEC_UNMARSHAL_FAILED                 = errors.TN(ALI_MQS_ERR_NS, 151, "codec {{.content_type}} unmarshal failed, {{.err}}")
+	ERR_MQS_ENCODE_BODY_FAILED                     = errors.TN(ALI_MQS_ERR_NS, 152, "encode message body of queue {{.queue}} failed, {{.err}}")
+	ERR_MQS_DECODE_BODY_FAILED                     = errors.TN(ALI_MQS_ERR_NS, 153, "decode message body of queue {{.queue}} failed, {{.err}}")
+	ERR_MQS_COMPRESSOR_NOT_REGISTERED              = errors.TN(ALI_MQS_ERR_NS, 154, "compressor {{.name}} is not registered")
+	ERR_MQS_BLOB_STORE_FAILED                      = errors.TN(ALI_MQS_ERR_NS, 155, "blob store {{.op}} failed, key: {{.key}}, error: {{.err}}")
+	ERR_MQS_INVALID_BLOB_KEY                       = errors.TN(ALI_MQS_ERR_NS, 156, "invalid blob key: {{.key}}")
+	ERR_MQS_INVALID_KEY_ID                         = errors.TN(ALI_MQS_ERR_NS, 157, "invalid encryption key id: {{.key_id}}")
+	ERR_MQS_KEY_NOT_FOUND                          = errors.TN(ALI_MQS_ERR_NS, 158, "encryption key not found, key id: {{.key_id}}")
+	ERR_MQS_MESSAGE_NOT_ENCRYPTED                  = errors.TN(ALI_MQS_ERR_NS, 159, "message body is not encrypted")
+	ERR_MQS_MESSAGE_TAMPERED                       = errors.TN(ALI_MQS_ERR_NS, 160, "message body could not be decrypted, key id: {{.key_id}}, error: {{.err}}")
+	ERR_MQS_SPOOL_FULL                             = errors.TN(ALI_MQS_ERR_NS, 161, "spool of queue {{.queue}} is full, max bytes: {{.max}}")
+	ERR_MQS_SPOOL_WRITE_FAILED                     = errors.TN(ALI_MQS_ERR_NS, 162, "write spool of queue {{.queue}} failed, {{.err}}")
+	ERR_MQS_MESSAGE_PRIORITY_RANGE_ERROR           = errors.TN(ALI_MQS_ERR_NS, 163, "message priority {{.priority}} is not in range of (1~16)")
+	ERR_MQS_MESSAGE_DELAY_SECONDS_RANGE_ERROR      = errors.TN(ALI_MQS_ERR_NS, 164, "message delay seconds {{.delay}} is not in range of (0~604800)")
+	ERR_MQS_MESSAGE_BODY_TOO_LARGE                 = errors.TN(ALI_MQS_ERR_NS, 165, "message body of {{.size}} bytes exceeds the max message size {{.max}} of queue {{.queue}}")
+	ERR_MQS_INVALID_DELIVERY_TIME                  = errors.TN(ALI_MQS_ERR_NS, 166, "invalid scheduled delivery time of message {{.id}}: {{.at}}")
+	ERR_MQS_RESOLVE_ENDPOINT_FAILED                = errors.TN(ALI_MQS_ERR_NS, 167, "resolve endpoint failed, owner id: {{.owner_id}}, location: {{.location}}")
+	ERR_MQS_INVALID_PROVISION_SPEC                 = errors.TN(ALI_MQS_ERR_NS, 168, "invalid provision spec, {{.err}}")
+	ERR_MQS_PROVISION_FAILED                       = errors.TN(ALI_MQS_ERR_NS, 169, "provision {{.action}} queue {{.queue}} in {{.location}} failed, {{.err}}")
+	ERR_MQS_DEAD_LETTER_TRUNCATED                  = errors.TN(ALI_MQS_ERR_NS, 170, "dead letter of message {{.id}} holds only part of its {{.size}} bytes body")
+	ERR_MQS_RECEIVE_NOT_SUPPORTED                  = errors.TN(ALI_MQS_ERR_NS, 171, "queue {{.queue}} does not implement MessageReceiver")
 )
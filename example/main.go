@@ -3,10 +3,10 @@ package main
 import (
 	"encoding/json"
 	"io/ioutil"
+	"log"
 	"time"
 
 	"github.com/gogap/ali_mqs"
-	"github.com/gogap/logs"
 )
 
 type appConf struct {
@@ -39,9 +39,9 @@ func main() {
 	ret, err := queue.SendMessage(msg)
 
 	if err != nil {
-		logs.Error(err)
+		log.Println(err)
 	} else {
-		logs.Pretty("response:", ret)
+		log.Printf("response: %+v\n", ret)
 	}
 
 	respChan := make(chan ali_mqs.MessageReceiveResponse)
@@ -51,22 +51,22 @@ func main() {
 			select {
 			case resp := <-respChan:
 				{
-					logs.Pretty("response:", resp)
-					logs.Debug("change the visibility: ", resp.ReceiptHandle)
+					log.Printf("response: %+v\n", resp)
+					log.Println("change the visibility:", resp.ReceiptHandle)
 					if ret, e := queue.ChangeMessageVisibility(resp.ReceiptHandle, 5); e != nil {
-						logs.Error(e)
+						log.Println(e)
 					} else {
-						logs.Pretty("visibility changed", ret)
+						log.Printf("visibility changed: %+v\n", ret)
 					}
 
-					logs.Debug("delete it now: ", resp.ReceiptHandle)
+					log.Println("delete it now:", resp.ReceiptHandle)
 					if e := queue.DeleteMessage(resp.ReceiptHandle); e != nil {
-						logs.Error(e)
+						log.Println(e)
 					}
 				}
 			case err := <-errChan:
 				{
-					logs.Error(err)
+					log.Println(err)
 				}
 			}
 		}
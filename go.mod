@@ -0,0 +1,15 @@
+module github.com/gogap/ali_mqs
+
+go 1.22
+
+require (
+	github.com/gogap/errors v0.0.0-20210818113853-edfbba0ddea9
+	github.com/golang/snappy v1.0.0
+	github.com/klauspost/compress v1.18.0
+	github.com/mreiferson/go-httpclient v0.0.0-20201222173833-5e475fde3a4d
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	google.golang.org/protobuf v1.33.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
@@ -0,0 +1,288 @@
+package ali_mqs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gogap/errors"
+)
+
+const (
+	DefaultLeaseVisibilityTimeout int64 = 30
+	DefaultLeaseRetryInterval           = time.Second
+)
+
+type LeaseKeeper struct {
+	queue             AliMQSQueue
+	visibilityTimeout int64
+	renewInterval     time.Duration
+	retryInterval     time.Duration
+}
+
+type MessageLease struct {
+	keeper *LeaseKeeper
+
+	changeLocker      sync.Mutex
+	locker            sync.Mutex
+	receiptHandle     string
+	nextVisibleTime   int64
+	visibilityTimeout int64
+	renewInterval     time.Duration
+	err               error
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopOnce sync.Once
+	stopChan chan bool
+	doneChan chan bool
+}
+
+func NewLeaseKeeper(queue AliMQSQueue, visibilityTimeout int64) *LeaseKeeper {
+	if queue == nil {
+		panic("ali_mqs: lease keeper queue could not be nil")
+	}
+
+	if visibilityTimeout <= 0 {
+		visibilityTimeout = DefaultLeaseVisibilityTimeout
+	}
+
+	if err := checkVisibilityTimeout(int32(visibilityTimeout)); err != nil {
+		panic(err)
+	}
+
+	return &LeaseKeeper{
+		queue:             queue,
+		visibilityTimeout: visibilityTimeout,
+		renewInterval:     toRenewInterval(visibilityTimeout),
+		retryInterval:     DefaultLeaseRetryInterval,
+	}
+}
+
+func toRenewInterval(visibilityTimeout int64) time.Duration {
+	renewInterval := time.Duration(visibilityTimeout) * time.Second / 2
+	if renewInterval < time.Second {
+		renewInterval = time.Second
+	}
+	return renewInterval
+}
+
+func (p *LeaseKeeper) VisibilityTimeout() int64 {
+	return p.visibilityTimeout
+}
+
+// Keep starts renewing the visibility of resp until the returned lease is
+// stopped. The lease context is canceled once the lease can no longer be
+// renewed, so handlers should give up and leave the message to be redelivered.
+func (p *LeaseKeeper) Keep(parent context.Context, resp MessageReceiveResponse) *MessageLease {
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	lease := &MessageLease{
+		keeper:            p,
+		receiptHandle:     resp.ReceiptHandle,
+		nextVisibleTime:   resp.NextVisibleTime,
+		visibilityTimeout: p.visibilityTimeout,
+		renewInterval:     p.renewInterval,
+		stopChan:          make(chan bool),
+		doneChan:          make(chan bool),
+	}
+
+	lease.ctx, lease.cancel = context.WithCancel(parent)
+
+	go lease.keep()
+
+	return lease
+}
+
+func (p *MessageLease) Context() context.Context {
+	return p.ctx
+}
+
+func (p *MessageLease) ReceiptHandle() string {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return p.receiptHandle
+}
+
+func (p *MessageLease) NextVisibleTime() int64 {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return p.nextVisibleTime
+}
+
+func (p *MessageLease) Err() error {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return p.err
+}
+
+// Stop ends the renewals and waits for any in-flight renewal, so the receipt
+// handle returned by ReceiptHandle afterwards is the one to delete with.
+func (p *MessageLease) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stopChan)
+	})
+	<-p.doneChan
+	p.cancel()
+}
+
+// Extend changes the visibility of the message to visibilityTimeout seconds
+// and keeps renewing it with that timeout from then on.
+func (p *MessageLease) Extend(visibilityTimeout int64) (err error) {
+	p.changeLocker.Lock()
+	defer p.changeLocker.Unlock()
+
+	if err = p.change(visibilityTimeout); err != nil {
+		return
+	}
+
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.visibilityTimeout = visibilityTimeout
+	p.renewInterval = toRenewInterval(visibilityTimeout)
+
+	return
+}
+
+// settle runs request with the receipt handle while no renewal is in flight.
+// The lease is stopped if request succeeded and keeps renewing otherwise, so
+// a failed request could be retried with the message still held.
+func (p *MessageLease) settle(request func(receiptHandle string) error) (err error) {
+	p.changeLocker.Lock()
+	if err = request(p.ReceiptHandle()); err == nil {
+		p.stopOnce.Do(func() {
+			close(p.stopChan)
+		})
+	}
+	p.changeLocker.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	p.Stop()
+
+	return
+}
+
+func (p *MessageLease) keep() {
+	defer close(p.doneChan)
+
+	timer := time.NewTimer(p.firstRenewal())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-p.stopChan:
+			return
+		case <-p.ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		if err := p.renew(); err != nil {
+			if !isLeaseRetryable(err) || p.expired() {
+				p.lose(err)
+				return
+			}
+			timer.Reset(p.keeper.retryInterval)
+			continue
+		}
+
+		timer.Reset(p.currentRenewInterval())
+	}
+}
+
+func (p *MessageLease) currentRenewInterval() time.Duration {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return p.renewInterval
+}
+
+// firstRenewal is half the time left of the visibility the message was
+// received with, which may be far shorter than the keeper timeout.
+func (p *MessageLease) firstRenewal() time.Duration {
+	nextVisibleTime := p.NextVisibleTime()
+	renewInterval := p.currentRenewInterval()
+	if nextVisibleTime <= 0 {
+		return renewInterval
+	}
+
+	remaining := time.Until(time.Unix(0, nextVisibleTime*int64(time.Millisecond)))
+	if delay := remaining / 2; delay < renewInterval {
+		if delay < 0 {
+			return 0
+		}
+		return delay
+	}
+
+	return renewInterval
+}
+
+func (p *MessageLease) renew() (err error) {
+	p.changeLocker.Lock()
+	defer p.changeLocker.Unlock()
+
+	select {
+	case <-p.stopChan:
+		// settled while waiting for the lock
+		return
+	default:
+	}
+
+	p.locker.Lock()
+	visibilityTimeout := p.visibilityTimeout
+	p.locker.Unlock()
+
+	return p.change(visibilityTimeout)
+}
+
+// change must be called with changeLocker held.
+func (p *MessageLease) change(visibilityTimeout int64) (err error) {
+	var resp MessageVisibilityChangeResponse
+	if resp, err = p.keeper.queue.ChangeMessageVisibility(p.ReceiptHandle(), visibilityTimeout); err != nil {
+		return
+	}
+
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.receiptHandle = resp.ReceiptHandle
+	p.nextVisibleTime = resp.NextVisibleTime
+
+	return
+}
+
+func (p *MessageLease) expired() bool {
+	nextVisibleTime := p.NextVisibleTime()
+	if nextVisibleTime <= 0 {
+		return false
+	}
+
+	return time.Now().UnixNano()/int64(time.Millisecond) >= nextVisibleTime
+}
+
+func (p *MessageLease) lose(err error) {
+	p.locker.Lock()
+	p.err = ERR_MQS_MESSAGE_LEASE_LOST.New(errors.Params{"queue": p.keeper.queue.Name(), "err": err})
+	p.locker.Unlock()
+
+	p.cancel()
+}
+
+func isLeaseRetryable(err error) bool {
+	switch {
+	case ERR_MQS_RECEIPT_HANDLE_ERROR.IsEqual(err),
+		ERR_MQS_MESSAGE_NOT_EXIST.IsEqual(err),
+		ERR_MQS_QUEUE_NOT_EXIST.IsEqual(err):
+		return false
+	}
+	return true
+}
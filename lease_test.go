@@ -0,0 +1,71 @@
+package ali_mqs
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLeaseRenewal(t *testing.T) {
+	queue := &memQueue{}
+
+	msg := NewMessage(queue, MessageReceiveResponse{
+		MessageId:       "1",
+		ReceiptHandle:   "handle",
+		NextVisibleTime: time.Now().Add(time.Millisecond*100).UnixNano() / int64(time.Millisecond),
+	})
+
+	ctx := msg.KeepAlive(context.Background(), NewLeaseKeeper(queue, 1))
+
+	// the first renewal is due at half the visibility left, the next ones
+	// every second
+	deadline := time.Now().Add(time.Second * 5)
+	for len(queue.Changed()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if changed := queue.Changed(); len(changed) < 2 || changed[0] != "handle" || changed[1] != "handle'" {
+		t.Fatalf("changed %v", changed)
+	}
+
+	if ctx.Err() != nil {
+		t.Fatal("lease context canceled while renewing")
+	}
+
+	if err := msg.Ack(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the message is deleted with the latest handle and renewals stop
+	renewals := len(queue.Changed())
+	if deleted := queue.Deleted(); len(deleted) != 1 || deleted[0] != msg.CurrentReceiptHandle() || deleted[0] == "handle" {
+		t.Fatalf("deleted %v, current handle %s", deleted, msg.CurrentReceiptHandle())
+	}
+
+	time.Sleep(time.Millisecond * 1200)
+
+	if len(queue.Changed()) != renewals {
+		t.Fatalf("renewed after ack: %v", queue.Changed())
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	queue := &memQueue{changeErr: ERR_MQS_MESSAGE_NOT_EXIST.New()}
+
+	lease := NewLeaseKeeper(queue, 1).Keep(context.Background(), MessageReceiveResponse{
+		MessageId:       "1",
+		ReceiptHandle:   "handle",
+		NextVisibleTime: time.Now().UnixNano() / int64(time.Millisecond),
+	})
+	defer lease.Stop()
+
+	select {
+	case <-lease.Context().Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("lease context not canceled")
+	}
+
+	if !ERR_MQS_MESSAGE_LEASE_LOST.IsEqual(lease.Err()) {
+		t.Fatalf("lease error %v", lease.Err())
+	}
+}
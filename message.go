@@ -1,8 +1,12 @@
 package ali_mqs
 
 import (
+	"bytes"
+	"crypto/md5"
 	"encoding/base64"
 	"encoding/xml"
+	"fmt"
+	"strings"
 
 	"github.com/gogap/errors"
 )
@@ -47,6 +51,7 @@ type CreateQueueRequest struct {
 
 type MessageReceiveResponse struct {
 	MessageResponse
+	MessageId        string      `xml:"MessageId" json:"message_id"`
 	ReceiptHandle    string      `xml:"ReceiptHandle" json:"receipt_handle"`
 	MessageBodyMD5   string      `xml:"MessageBodyMD5" json:"message_body_md5"`
 	MessageBody      Base64Bytes `xml:"MessageBody" json:"message_body"`
@@ -55,6 +60,8 @@ type MessageReceiveResponse struct {
 	FirstDequeueTime int64       `xml:"FirstDequeueTime" json:"first_dequeue_time"`
 	DequeueCount     int64       `xml:"DequeueCount" json:"dequeue_count"`
 	Priority         int64       `xml:"Priority" json:"priority"`
+
+	wireBody []byte
 }
 
 type MessageVisibilityChangeResponse struct {
@@ -111,3 +118,52 @@ func (p *Base64Bytes) UnmarshalXML(d *xml.Decoder, start xml.StartElement) (err
 
 	return nil
 }
+
+// MessageBodyMD5 returns the md5 the service computes of a message body, the
+// body is sent base64 encoded and the service hashes the encoded text.
+func MessageBodyMD5(body []byte) string {
+	return fmt.Sprintf("%X", md5.Sum([]byte(base64.StdEncoding.EncodeToString(body))))
+}
+
+func verifyMessageBodyMD5(queueName, messageId string, body []byte, expectedMD5 string) (err error) {
+	if actualMD5 := MessageBodyMD5(body); !strings.EqualFold(actualMD5, expectedMD5) {
+		err = ERR_MQS_MESSAGE_BODY_CORRUPTED.New(errors.Params{"queue": queueName, "id": messageId, "expected": expectedMD5, "actual": actualMD5})
+		return
+	}
+	return
+}
+
+type BodyFilter interface {
+	EncodeBody(body []byte) (encoded []byte, err error)
+	DecodeBody(body []byte) (decoded []byte, err error)
+}
+
+// a body header is a zero byte, key=value and a newline in front of the
+// payload, it records how the payload was encoded without message attributes
+const (
+	bodyHeaderMark = 0x00
+)
+
+func encodeBodyHeader(key, value string, payload []byte) []byte {
+	body := make([]byte, 0, len(key)+len(value)+3+len(payload))
+	body = append(body, bodyHeaderMark)
+	body = append(body, key...)
+	body = append(body, '=')
+	body = append(body, value...)
+	body = append(body, '\n')
+	return append(body, payload...)
+}
+
+func decodeBodyHeader(body []byte, key string) (value string, payload []byte, ok bool) {
+	prefix := append([]byte{bodyHeaderMark}, key+"="...)
+	if !bytes.HasPrefix(body, prefix) {
+		return "", body, false
+	}
+
+	end := bytes.IndexByte(body, '\n')
+	if end < 0 {
+		return "", body, false
+	}
+
+	return string(body[len(prefix):end]), body[end+1:], true
+}
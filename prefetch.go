@@ -0,0 +1,281 @@
+package ali_mqs
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogap/errors"
+)
+
+const (
+	DefaultPrefetchSize          = 10
+	DefaultPrefetchReleaseMargin = time.Second * 5
+)
+
+type prefetchedMessage struct {
+	msg       *Message
+	fetchedAt time.Time
+}
+
+// PrefetchReceiver keeps up to size messages received in the background, and
+// releases those which would become visible again before they are taken.
+type PrefetchReceiver struct {
+	queue         AliMQSQueue
+	receiver      MessageReceiver
+	size          int
+	waitseconds   []int64
+	releaseMargin time.Duration
+
+	locker sync.Mutex
+	buffer []prefetchedMessage
+	err    error
+
+	readyChan chan bool
+	spaceChan chan bool
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopOnce sync.Once
+	doneChan chan bool
+
+	released int64
+}
+
+func NewPrefetchReceiver(queue AliMQSQueue, size int, waitseconds ...int64) *PrefetchReceiver {
+	if queue == nil {
+		panic("ali_mqs: prefetch queue could not be nil")
+	}
+
+	messageReceiver, ok := queue.(MessageReceiver)
+	if !ok {
+		panic("ali_mqs: prefetch queue must implement MessageReceiver")
+	}
+
+	if size <= 0 {
+		size = DefaultPrefetchSize
+	}
+
+	receiver := &PrefetchReceiver{
+		queue:         queue,
+		receiver:      messageReceiver,
+		size:          size,
+		waitseconds:   waitseconds,
+		releaseMargin: DefaultPrefetchReleaseMargin,
+		readyChan:     make(chan bool, 1),
+		spaceChan:     make(chan bool, 1),
+		doneChan:      make(chan bool),
+	}
+
+	receiver.ctx, receiver.cancel = context.WithCancel(context.Background())
+
+	go receiver.fill()
+	go receiver.sweepLoop()
+
+	return receiver
+}
+
+func (p *PrefetchReceiver) SetReleaseMargin(margin time.Duration) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.releaseMargin = margin
+}
+
+func (p *PrefetchReceiver) Len() int {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return len(p.buffer)
+}
+
+// OldestAge returns how long the oldest buffered message has been waiting.
+func (p *PrefetchReceiver) OldestAge() time.Duration {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if len(p.buffer) == 0 {
+		return 0
+	}
+
+	return time.Since(p.buffer[0].fetchedAt)
+}
+
+func (p *PrefetchReceiver) Released() int64 {
+	return atomic.LoadInt64(&p.released)
+}
+
+// Receive takes the oldest buffered message, waiting for one if the buffer
+// is empty. An error the background receive ran into is returned once.
+func (p *PrefetchReceiver) Receive(ctx context.Context) (msg *Message, err error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	for {
+		var expired []*Message
+
+		p.locker.Lock()
+		for len(p.buffer) > 0 && msg == nil {
+			item := p.buffer[0]
+			p.buffer = p.buffer[1:]
+			if p.expiring(item) {
+				expired = append(expired, item.msg)
+				continue
+			}
+			msg = item.msg
+		}
+		err, p.err = p.err, nil
+		p.locker.Unlock()
+
+		p.release(expired)
+		notify(p.spaceChan)
+
+		if msg != nil {
+			return msg, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-p.ctx.Done():
+			return nil, ERR_MQS_RECEIVER_STOPPED.New(errors.Params{"queue": p.queue.Name()})
+		case <-p.readyChan:
+		}
+	}
+}
+
+// Stop stops prefetching and releases the buffered messages.
+func (p *PrefetchReceiver) Stop() {
+	p.stopOnce.Do(func() {
+		p.cancel()
+		<-p.doneChan
+
+		p.locker.Lock()
+		buffered := make([]*Message, 0, len(p.buffer))
+		for _, item := range p.buffer {
+			buffered = append(buffered, item.msg)
+		}
+		p.buffer = nil
+		p.locker.Unlock()
+
+		p.release(buffered)
+	})
+}
+
+func (p *PrefetchReceiver) fill() {
+	defer close(p.doneChan)
+
+	failures := int64(0)
+
+	for {
+		if p.Len() >= p.size {
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-p.spaceChan:
+			}
+			continue
+		}
+
+		msg, err := p.receiver.Receive(p.ctx, p.waitseconds...)
+
+		select {
+		case <-p.ctx.Done():
+			if msg != nil {
+				p.release([]*Message{msg})
+			}
+			return
+		default:
+		}
+
+		if err != nil {
+			failures++
+
+			if !ERR_MQS_NO_MESSAGE.IsEqual(err) {
+				p.locker.Lock()
+				p.err = err
+				p.locker.Unlock()
+				notify(p.readyChan)
+			}
+
+			timer := time.NewTimer(DefaultPollBackoff.Delay(failures))
+			select {
+			case <-p.ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			continue
+		}
+
+		failures = 0
+
+		p.locker.Lock()
+		p.buffer = append(p.buffer, prefetchedMessage{msg: msg, fetchedAt: time.Now()})
+		p.locker.Unlock()
+
+		notify(p.readyChan)
+	}
+}
+
+func (p *PrefetchReceiver) sweepLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.sweep()
+		}
+	}
+}
+
+func (p *PrefetchReceiver) sweep() {
+	var expired []*Message
+
+	p.locker.Lock()
+	buffer := p.buffer[:0]
+	for _, item := range p.buffer {
+		if p.expiring(item) {
+			expired = append(expired, item.msg)
+			continue
+		}
+		buffer = append(buffer, item)
+	}
+	p.buffer = buffer
+	p.locker.Unlock()
+
+	p.release(expired)
+	notify(p.spaceChan)
+}
+
+func (p *PrefetchReceiver) expiring(item prefetchedMessage) bool {
+	if item.msg.NextVisibleTime <= 0 {
+		return false
+	}
+
+	visibleAt := time.Unix(0, item.msg.NextVisibleTime*int64(time.Millisecond))
+
+	return time.Now().Add(p.releaseMargin).After(visibleAt)
+}
+
+func (p *PrefetchReceiver) release(msgs []*Message) {
+	for _, msg := range msgs {
+		if msg.Nack(0) == nil {
+			atomic.AddInt64(&p.released, 1)
+		}
+	}
+}
+
+func notify(ch chan bool) {
+	select {
+	case ch <- true:
+	default:
+	}
+}
@@ -0,0 +1,326 @@
+package ali_mqs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gogap/errors"
+)
+
+const (
+	DefaultProducerBufferSize  = 1000
+	DefaultProducerBatchSize   = 16
+	DefaultProducerLinger      = time.Millisecond * 10
+	DefaultProducerConcurrency = 4
+	DefaultProducerMaxRetries  = 3
+)
+
+var (
+	DefaultSendRetryBackoff Backoff = ExponentialBackoff{
+		Initial:    time.Millisecond * 100,
+		Max:        time.Second * 5,
+		Multiplier: 2,
+	}
+)
+
+// IsTransientError reports errors worth retrying, the request did not reach
+// the service or the service failed internally.
+func IsTransientError(err error) bool {
+	switch {
+	case ERR_SEND_REQUEST_FAILED.IsEqual(err),
+		ERR_READ_RESPONSE_BODY_FAILED.IsEqual(err),
+		ERR_MQS_INTERNAL_ERROR.IsEqual(err):
+		return true
+	}
+	return false
+}
+
+type SendCallback func(resp MessageSendResponse, err error)
+
+type SendFuture struct {
+	message  MessageSendRequest
+	callback SendCallback
+	doneChan chan bool
+	once     sync.Once
+	resp     MessageSendResponse
+	err      error
+}
+
+func (p *SendFuture) Done() <-chan bool {
+	return p.doneChan
+}
+
+func (p *SendFuture) Result() (resp MessageSendResponse, err error) {
+	<-p.doneChan
+	return p.resp, p.err
+}
+
+// complete takes the first result only, a send finishing after Close gave
+// up on it is not reported.
+func (p *SendFuture) complete(resp MessageSendResponse, err error) {
+	p.once.Do(func() {
+		p.resp = resp
+		p.err = err
+
+		if p.callback != nil {
+			p.callback(resp, err)
+		}
+
+		close(p.doneChan)
+	})
+}
+
+type ProducerOptions struct {
+	BufferSize int
+
+	// BatchSize and Linger bound how many messages are coalesced and how
+	// long the first of them waits for the batch to fill. The service has no
+	// batch send, the messages of a batch are sent concurrently.
+	BatchSize   int
+	Linger      time.Duration
+	Concurrency int
+
+	MaxRetries   int
+	RetryBackoff Backoff
+}
+
+type Producer struct {
+	queue   AliMQSQueue
+	options ProducerOptions
+
+	locker      sync.RWMutex
+	closed      bool
+	closingChan chan bool
+	closeOnce   sync.Once
+	inputChan   chan *SendFuture
+
+	batchChan chan bool
+	batches   sync.WaitGroup
+	doneChan  chan bool
+
+	pendingLocker sync.Mutex
+	pending       map[*SendFuture]bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewProducer(queue AliMQSQueue, options ProducerOptions) *Producer {
+	if queue == nil {
+		panic("ali_mqs: producer queue could not be nil")
+	}
+
+	if options.BufferSize <= 0 {
+		options.BufferSize = DefaultProducerBufferSize
+	}
+
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultProducerBatchSize
+	}
+
+	if options.Linger <= 0 {
+		options.Linger = DefaultProducerLinger
+	}
+
+	if options.Concurrency <= 0 {
+		options.Concurrency = DefaultProducerConcurrency
+	}
+
+	if options.MaxRetries < 0 {
+		options.MaxRetries = 0
+	} else if options.MaxRetries == 0 {
+		options.MaxRetries = DefaultProducerMaxRetries
+	}
+
+	if options.RetryBackoff == nil {
+		options.RetryBackoff = DefaultSendRetryBackoff
+	}
+
+	producer := &Producer{
+		queue:       queue,
+		options:     options,
+		closingChan: make(chan bool),
+		inputChan:   make(chan *SendFuture, options.BufferSize),
+		batchChan:   make(chan bool, options.Concurrency),
+		doneChan:    make(chan bool),
+		pending:     make(map[*SendFuture]bool),
+	}
+
+	producer.ctx, producer.cancel = context.WithCancel(context.Background())
+
+	go producer.run()
+
+	return producer
+}
+
+// Send buffers message, blocking while the buffer is full until ctx is done.
+func (p *Producer) Send(ctx context.Context, message MessageSendRequest, callback ...SendCallback) (future *SendFuture, err error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	future = &SendFuture{
+		message:  message,
+		doneChan: make(chan bool),
+	}
+
+	if len(callback) > 0 {
+		future.callback = callback[0]
+	}
+
+	p.locker.RLock()
+	defer p.locker.RUnlock()
+
+	if p.closed {
+		return nil, ERR_MQS_PRODUCER_CLOSED.New(errors.Params{"queue": p.queue.Name()})
+	}
+
+	p.addPending(future)
+
+	select {
+	case p.inputChan <- future:
+	case <-ctx.Done():
+		p.removePending(future)
+		return nil, ctx.Err()
+	case <-p.closingChan:
+		p.removePending(future)
+		return nil, ERR_MQS_PRODUCER_CLOSED.New(errors.Params{"queue": p.queue.Name()})
+	}
+
+	return
+}
+
+// Close stops accepting messages and flushes the buffered ones. At timeout
+// every message not sent yet, buffered or in flight, is completed with
+// ERR_MQS_PRODUCER_CLOSED and Close returns without waiting for the requests
+// in flight, so such a message may still reach the queue.
+func (p *Producer) Close(timeout time.Duration) (err error) {
+	p.closeOnce.Do(func() {
+		close(p.closingChan)
+
+		p.locker.Lock()
+		p.closed = true
+		close(p.inputChan)
+		p.locker.Unlock()
+	})
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-p.doneChan:
+		return
+	case <-timer.C:
+	}
+
+	p.cancel()
+
+	p.pendingLocker.Lock()
+	pending := p.pending
+	p.pending = make(map[*SendFuture]bool)
+	p.pendingLocker.Unlock()
+
+	for future := range pending {
+		future.complete(MessageSendResponse{}, ERR_MQS_PRODUCER_CLOSED.New(errors.Params{"queue": p.queue.Name()}))
+	}
+
+	return ERR_MQS_PRODUCER_FLUSH_TIMEOUT.New(errors.Params{"queue": p.queue.Name(), "timeout": timeout})
+}
+
+func (p *Producer) run() {
+	defer close(p.doneChan)
+
+	for {
+		first, ok := <-p.inputChan
+		if !ok {
+			break
+		}
+
+		batch := []*SendFuture{first}
+		closed := false
+
+		timer := time.NewTimer(p.options.Linger)
+	collect:
+		for len(batch) < p.options.BatchSize {
+			select {
+			case future, ok := <-p.inputChan:
+				if !ok {
+					closed = true
+					break collect
+				}
+				batch = append(batch, future)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		p.dispatch(batch)
+
+		if closed {
+			break
+		}
+	}
+
+	p.batches.Wait()
+}
+
+func (p *Producer) dispatch(batch []*SendFuture) {
+	p.batchChan <- true
+	p.batches.Add(1)
+
+	go func() {
+		defer func() {
+			<-p.batchChan
+			p.batches.Done()
+		}()
+
+		var wg sync.WaitGroup
+		for _, future := range batch {
+			wg.Add(1)
+			go func(future *SendFuture) {
+				defer wg.Done()
+				resp, err := p.send(future.message)
+				p.removePending(future)
+				future.complete(resp, err)
+			}(future)
+		}
+		wg.Wait()
+	}()
+}
+
+func (p *Producer) addPending(future *SendFuture) {
+	p.pendingLocker.Lock()
+	defer p.pendingLocker.Unlock()
+
+	p.pending[future] = true
+}
+
+func (p *Producer) removePending(future *SendFuture) {
+	p.pendingLocker.Lock()
+	defer p.pendingLocker.Unlock()
+
+	delete(p.pending, future)
+}
+
+func (p *Producer) send(message MessageSendRequest) (resp MessageSendResponse, err error) {
+	for retries := 0; ; retries++ {
+		if p.ctx.Err() != nil {
+			err = ERR_MQS_PRODUCER_CLOSED.New(errors.Params{"queue": p.queue.Name()})
+			return
+		}
+
+		if resp, err = p.queue.SendMessage(message); err == nil || !IsTransientError(err) || retries >= p.options.MaxRetries {
+			return
+		}
+
+		timer := time.NewTimer(p.options.RetryBackoff.Delay(int64(retries + 1)))
+		select {
+		case <-p.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package ali_mqs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/gogap/errors"
+)
+
+const (
+	DefaultDeletedRecentlyRetryInterval = time.Second * 10
+	DefaultDeletedRecentlyMaxWait       = time.Minute * 2
+)
+
+// ProvisionSpec declares the queues of each location. The struct tags serve
+// JSON and YAML, YAML specs are unmarshaled by the caller and checked with
+// Check, so this package does not depend on a YAML library.
+type ProvisionSpec struct {
+	Locations []LocationSpec `json:"locations" yaml:"locations"`
+}
+
+// LocationSpec lists the queues of a location. Only queues starting with
+// Prefix are compared against the spec, which keeps pruning away from queues
+// managed elsewhere.
+type LocationSpec struct {
+	Location MQSLocation `json:"location" yaml:"location"`
+	Prefix   string      `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	Queues   []QueueSpec `json:"queues" yaml:"queues"`
+}
+
+type QueueSpec struct {
+	Name            string `json:"name" yaml:"name"`
+	QueueAttributes `yaml:",inline"`
+}
+
+func ParseProvisionSpec(data []byte) (spec ProvisionSpec, err error) {
+	if err = json.Unmarshal(data, &spec); err != nil {
+		err = ERR_MQS_INVALID_PROVISION_SPEC.New(errors.Params{"err": err})
+		return
+	}
+
+	err = spec.Check()
+
+	return
+}
+
+func LoadProvisionSpec(filename string) (spec ProvisionSpec, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(filename); err != nil {
+		err = ERR_MQS_INVALID_PROVISION_SPEC.New(errors.Params{"err": err})
+		return
+	}
+
+	return ParseProvisionSpec(data)
+}
+
+func (p ProvisionSpec) Check() (err error) {
+	locations := map[MQSLocation]bool{}
+	for _, location := range p.Locations {
+		if location.Location == "" || locations[location.Location] {
+			err = ERR_MQS_INVALID_PROVISION_SPEC.New(errors.Params{"err": fmt.Sprintf("empty or duplicate location %q", location.Location)})
+			return
+		}
+		locations[location.Location] = true
+
+		names := map[string]bool{}
+		for _, queue := range location.Queues {
+			if queue.Name == "" || names[queue.Name] || !strings.HasPrefix(queue.Name, location.Prefix) {
+				err = ERR_MQS_INVALID_PROVISION_SPEC.New(errors.Params{"err": fmt.Sprintf("empty, duplicate or unprefixed queue name %q in %s", queue.Name, location.Location)})
+				return
+			}
+			names[queue.Name] = true
+
+			if err = checkQueueName(queue.Name); err != nil {
+				return
+			}
+
+			if err = queue.Check(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+type ProvisionAction string
+
+const (
+	ProvisionCreate ProvisionAction = "create"
+	ProvisionUpdate ProvisionAction = "update"
+	ProvisionDelete ProvisionAction = "delete"
+)
+
+// ProvisionStep holds the attributes to create a queue with, or the changed
+// attributes for an update.
+type ProvisionStep struct {
+	Action     ProvisionAction `json:"action"`
+	Location   MQSLocation     `json:"location"`
+	Queue      string          `json:"queue"`
+	Attributes QueueAttributes `json:"attributes"`
+}
+
+type ProvisionPlan struct {
+	Steps []ProvisionStep `json:"steps"`
+}
+
+func (p ProvisionPlan) IsEmpty() bool {
+	return len(p.Steps) == 0
+}
+
+func (p ProvisionPlan) String() string {
+	if p.IsEmpty() {
+		return "no changes\n"
+	}
+
+	signs := map[ProvisionAction]string{
+		ProvisionCreate: "+",
+		ProvisionUpdate: "~",
+		ProvisionDelete: "-",
+	}
+
+	buf := bytes.NewBuffer(nil)
+	for _, step := range p.Steps {
+		fmt.Fprintf(buf, "%s %s %s/%s", signs[step.Action], step.Action, step.Location, step.Queue)
+		for _, attr := range []struct {
+			name  string
+			value *int32
+		}{
+			{"delay_seconds", step.Attributes.DelaySeconds},
+			{"maximum_message_size", step.Attributes.MaxMessageSize},
+			{"message_retention_period", step.Attributes.MessageRetentionPeriod},
+			{"visibility_timeout", step.Attributes.VisibilityTimeout},
+			{"polling_wait_seconds", step.Attributes.PollingWaitSeconds},
+		} {
+			if attr.value != nil {
+				fmt.Fprintf(buf, " %s=%d", attr.name, *attr.value)
+			}
+		}
+		buf.WriteString("\n")
+	}
+
+	return buf.String()
+}
+
+type ProvisionOptions struct {
+	// Prune plans deletes for the listed queues missing from the spec.
+	Prune bool
+
+	// PruneAll lets Prune delete in locations without a Prefix, where every
+	// queue of the location missing from the spec is deleted. Plan refuses to
+	// prune such locations otherwise.
+	PruneAll bool
+
+	// a queue deleted recently could not be created again for a while, the
+	// create is retried every DeletedRecentlyRetryInterval until
+	// DeletedRecentlyMaxWait passed
+	DeletedRecentlyRetryInterval time.Duration
+	DeletedRecentlyMaxWait       time.Duration
+
+	Concurrency int
+}
+
+// Provisioner reconciles the queues of the service with a ProvisionSpec.
+type Provisioner struct {
+	manager    AliQueueManager
+	attributes QueueAttributesManager
+	options    ProvisionOptions
+}
+
+func NewProvisioner(manager AliQueueManager, options ProvisionOptions) *Provisioner {
+	if manager == nil {
+		panic("ali_mqs: provisioner queue manager could not be nil")
+	}
+
+	attributes, ok := manager.(QueueAttributesManager)
+	if !ok {
+		panic("ali_mqs: provisioner queue manager must implement QueueAttributesManager")
+	}
+
+	if options.DeletedRecentlyRetryInterval <= 0 {
+		options.DeletedRecentlyRetryInterval = DefaultDeletedRecentlyRetryInterval
+	}
+
+	if options.DeletedRecentlyMaxWait <= 0 {
+		options.DeletedRecentlyMaxWait = DefaultDeletedRecentlyMaxWait
+	}
+
+	return &Provisioner{
+		manager:    manager,
+		attributes: attributes,
+		options:    options,
+	}
+}
+
+func (p *Provisioner) Plan(ctx context.Context, spec ProvisionSpec) (plan ProvisionPlan, err error) {
+	if err = spec.Check(); err != nil {
+		return
+	}
+
+	if p.options.Prune && !p.options.PruneAll {
+		for _, location := range spec.Locations {
+			if location.Prefix == "" {
+				err = ERR_MQS_INVALID_PROVISION_SPEC.New(errors.Params{"err": fmt.Sprintf("prune of %s without prefix would delete all its queues missing from the spec, set a prefix or prune all", location.Location)})
+				return
+			}
+		}
+	}
+
+	for _, location := range spec.Locations {
+		var queues []QueueInfo
+		if queues, err = ListAllQueues(ctx, p.manager, location.Location, location.Prefix, ListQueuesOptions{
+			WithAttributes: true,
+			Concurrency:    p.options.Concurrency,
+		}); err != nil {
+			return
+		}
+
+		existing := map[string]QueueAttribute{}
+		for _, queue := range queues {
+			existing[queue.Name] = *queue.Attribute
+		}
+
+		declared := map[string]bool{}
+		for _, queue := range location.Queues {
+			declared[queue.Name] = true
+
+			current, exist := existing[queue.Name]
+			if !exist {
+				plan.Steps = append(plan.Steps, ProvisionStep{Action: ProvisionCreate, Location: location.Location, Queue: queue.Name, Attributes: queue.QueueAttributes})
+			} else if changes := queue.Changes(current); !changes.IsEmpty() {
+				plan.Steps = append(plan.Steps, ProvisionStep{Action: ProvisionUpdate, Location: location.Location, Queue: queue.Name, Attributes: changes})
+			}
+		}
+
+		if !p.options.Prune {
+			continue
+		}
+
+		for _, queue := range queues {
+			if !declared[queue.Name] {
+				plan.Steps = append(plan.Steps, ProvisionStep{Action: ProvisionDelete, Location: location.Location, Queue: queue.Name})
+			}
+		}
+	}
+
+	return
+}
+
+// Apply runs the steps of plan in order and stops at the first failure,
+// applied is the number of steps done.
+func (p *Provisioner) Apply(ctx context.Context, plan ProvisionPlan) (applied int, err error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	for _, step := range plan.Steps {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		if err = p.apply(ctx, step); err != nil {
+			err = ERR_MQS_PROVISION_FAILED.New(errors.Params{"action": step.Action, "location": step.Location, "queue": step.Queue, "err": err})
+			return
+		}
+
+		applied++
+	}
+
+	return
+}
+
+func (p *Provisioner) apply(ctx context.Context, step ProvisionStep) (err error) {
+	switch step.Action {
+	case ProvisionCreate:
+		return p.create(ctx, step)
+	case ProvisionUpdate:
+		_, err = p.attributes.UpdateQueueAttributes(step.Location, step.Queue, step.Attributes)
+	case ProvisionDelete:
+		if err = p.manager.DeleteQueue(step.Location, step.Queue); ERR_MQS_QUEUE_NOT_EXIST.IsEqual(err) {
+			err = nil
+		}
+	}
+	return
+}
+
+func (p *Provisioner) create(ctx context.Context, step ProvisionStep) (err error) {
+	deadline := time.Now().Add(p.options.DeletedRecentlyMaxWait)
+
+	for {
+		err = p.attributes.CreateQueueWithAttributes(step.Location, step.Queue, step.Attributes)
+
+		switch {
+		case err == nil, ERR_MQS_QUEUE_ALREADY_EXIST_AND_HAVE_SAME_ATTR.IsEqual(err):
+			return nil
+		case ERR_MQS_QUEUE_ALREADY_EXIST.IsEqual(err):
+			// created since the plan was made, with other attributes
+			_, err = p.attributes.UpdateQueueAttributes(step.Location, step.Queue, step.Attributes)
+			return
+		case !ERR_MQS_QUEUE_DELETED_RECENTLY.IsEqual(err) || time.Now().After(deadline):
+			return
+		}
+
+		timer := time.NewTimer(p.options.DeletedRecentlyRetryInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -1,20 +1,46 @@
 package ali_mqs
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogap/errors"
 )
 
 var (
 	RECEIVER_COUNT = 10
 )
 
+var (
+	DefaultPollBackoff Backoff = ExponentialBackoff{
+		Initial:    time.Second,
+		Max:        time.Second * 30,
+		Multiplier: 2,
+	}
+)
+
 const (
 	PROXY_PREFIX = "MQS_PROXY_"
 	GLOBAL_PROXY = "MQS_GLOBAL_PROXY"
 )
 
+const (
+	MaxPollingWaitSeconds int64 = 30
+
+	MinMessagePriority     int64 = 1
+	MaxMessagePriority     int64 = 16
+	MaxMessageDelaySeconds int64 = 604800
+	MaxMessageSize         int32 = 65536
+
+	DefaultQueueAttributeTTL = time.Minute * 5
+)
+
 type AliMQSQueue interface {
 	Name() string
 	SendMessage(message MessageSendRequest) (resp MessageSendResponse, err error)
@@ -25,13 +51,100 @@ type AliMQSQueue interface {
 	Stop()
 }
 
+// MessageReceiver is implemented by queues which receive one message at a
+// time, as needed by Consumer, PrefetchReceiver, TypedQueue and Redrive.
+type MessageReceiver interface {
+	Receive(ctx context.Context, waitseconds ...int64) (msg *Message, err error)
+	Peek(ctx context.Context) (msg *Message, err error)
+}
+
+type QueueAttributeGetter interface {
+	GetAttributes() (attr QueueAttribute, err error)
+}
+
+type QueueStatsProvider interface {
+	Stats() QueueStats
+}
+
+func receiverOf(queue AliMQSQueue) (receiver MessageReceiver, err error) {
+	var ok bool
+	if receiver, ok = queue.(MessageReceiver); !ok {
+		err = ERR_MQS_RECEIVE_NOT_SUPPORTED.New(errors.Params{"queue": queue.Name()})
+		return
+	}
+	return
+}
+
+type QueueStats struct {
+	Received   int64 `json:"received"`
+	EmptyPolls int64 `json:"empty_polls"`
+	Errors     int64 `json:"errors"`
+}
+
+type QueueOption func(queue *MQSQueue)
+
+// WithMD5Verification compares the MessageBodyMD5 the service returns on send
+// and receive with the body, a mismatch fails with ERR_MQS_MESSAGE_BODY_CORRUPTED
+// and the received message is left undeleted.
+func WithMD5Verification() QueueOption {
+	return func(queue *MQSQueue) {
+		queue.verifyMD5 = true
+	}
+}
+
+// WithBodyFilters encodes message bodies with filters in order before they
+// are sent, and decodes received bodies in the reverse order.
+func WithBodyFilters(filters ...BodyFilter) QueueOption {
+	return func(queue *MQSQueue) {
+		queue.filters = append(queue.filters, filters...)
+	}
+}
+
+// WithReleaseErrorHandler receives the errors of BodyReleaser filters, which
+// are not returned by Ack as the message is deleted already, nor by a failed
+// SendMessage which releases the encoded body.
+func WithReleaseErrorHandler(handler func(body []byte, err error)) QueueOption {
+	return func(queue *MQSQueue) {
+		queue.onReleaseError = handler
+	}
+}
+
+// WithSendValidation checks the body size of sent messages against the max
+// message size of the queue instead of the service limit. The size is read
+// from the queue attributes, which are cached for ttl and may be reloaded
+// with RefreshAttributes.
+func WithSendValidation(ttl time.Duration) QueueOption {
+	return func(queue *MQSQueue) {
+		if ttl <= 0 {
+			ttl = DefaultQueueAttributeTTL
+		}
+		queue.validateSend = true
+		queue.attrTTL = ttl
+	}
+}
+
 type MQSQueue struct {
-	name     string
-	client   MQSClient
-	stopChan chan bool
+	name         string
+	client       MQSClient
+	stopChan     chan bool
+	pollBackoff  Backoff
+	verifyMD5    bool
+	filters      []BodyFilter
+	validateSend bool
+
+	onReleaseError func(body []byte, err error)
+
+	attrLocker   sync.Mutex
+	attrTTL      time.Duration
+	attr         QueueAttribute
+	attrLoadTime time.Time
+
+	received   int64
+	emptyPolls int64
+	errors     int64
 }
 
-func NewMQSQueue(name string, client MQSClient) AliMQSQueue {
+func NewMQSQueue(name string, client MQSClient, options ...QueueOption) AliMQSQueue {
 	if name == "" {
 		panic("ali_mqs: queue name could not be empty")
 	}
@@ -40,6 +153,11 @@ func NewMQSQueue(name string, client MQSClient) AliMQSQueue {
 	queue.client = client
 	queue.name = name
 	queue.stopChan = make(chan bool)
+	queue.pollBackoff = DefaultPollBackoff
+
+	for _, option := range options {
+		option(queue)
+	}
 
 	proxyURL := ""
 	queueProxyEnvKey := PROXY_PREFIX + strings.Replace(strings.ToUpper(name), "-", "_", -1)
@@ -60,8 +178,37 @@ func (p *MQSQueue) Name() string {
 	return p.name
 }
 
+// SendMessage checks priority and delay seconds before the body filters run,
+// and the size of the encoded body before the request is made.
 func (p *MQSQueue) SendMessage(message MessageSendRequest) (resp MessageSendResponse, err error) {
-	_, err = p.client.Send(POST, nil, message, fmt.Sprintf("%s/%s", p.name, "messages"), &resp)
+	if err = checkMessagePriority(message.Priority); err != nil {
+		return
+	}
+
+	if err = checkMessageDelaySeconds(message.DelaySeconds); err != nil {
+		return
+	}
+
+	if message.MessageBody, err = p.encodeBody(message.MessageBody); err != nil {
+		return
+	}
+
+	if err = p.checkMessageSize(message.MessageBody); err != nil {
+		p.releaseBody(message.MessageBody)
+		return
+	}
+
+	if _, err = p.client.Send(POST, nil, message, fmt.Sprintf("%s/%s", p.name, "messages"), &resp); err != nil {
+		// a request which failed after reaching the service may have sent the
+		// message, whose blob is gone then
+		p.releaseBody(message.MessageBody)
+		return
+	}
+
+	if p.verifyMD5 {
+		err = verifyMessageBodyMD5(p.name, resp.MessageId, message.MessageBody, resp.MessageBodyMD5)
+	}
+
 	return
 }
 
@@ -69,37 +216,175 @@ func (p *MQSQueue) Stop() {
 	p.stopChan <- true
 }
 
-func (p *MQSQueue) ReceiveMessage(respChan chan MessageReceiveResponse, errChan chan error, waitseconds ...int64) {
+func (p *MQSQueue) Stats() QueueStats {
+	return QueueStats{
+		Received:   atomic.LoadInt64(&p.received),
+		EmptyPolls: atomic.LoadInt64(&p.emptyPolls),
+		Errors:     atomic.LoadInt64(&p.errors),
+	}
+}
+
+func (p *MQSQueue) receiveResource(waitseconds int64, peekOnly bool) string {
 	resource := fmt.Sprintf("%s/%s", p.name, "messages")
+	if peekOnly {
+		return resource + "?peekonly=true"
+	}
+	if waitseconds >= 0 {
+		resource = fmt.Sprintf("%s?waitseconds=%d", resource, waitseconds)
+	}
+	return resource
+}
+
+// ReceiveMessage polls until Stop is called. An empty queue is not reported
+// to errChan, instead the next poll is a long poll and further empty polls
+// sleep with pollBackoff in between.
+func (p *MQSQueue) ReceiveMessage(respChan chan MessageReceiveResponse, errChan chan error, waitseconds ...int64) {
+	wait := int64(-1)
 	if waitseconds != nil && len(waitseconds) == 1 {
-		resource = fmt.Sprintf("%s/%s?waitseconds=%d", p.name, "messages", waitseconds[0])
+		wait = waitseconds[0]
 	}
 
+	emptyPolls := int64(0)
+
 	for {
-		resp := MessageReceiveResponse{}
-		_, err := p.client.Send(GET, nil, nil, resource, &resp)
-		if err != nil {
-			errChan <- err
-		} else {
+		pollWait := wait
+		if emptyPolls > 0 && pollWait < 0 {
+			pollWait = MaxPollingWaitSeconds
+		}
+
+		var sleep time.Duration
+
+		resp, err := p.receiveOnce(p.receiveResource(pollWait, false))
+		if err == nil {
+			emptyPolls = 0
 			respChan <- resp
+		} else if ERR_MQS_MESSAGE_NOT_EXIST.IsEqual(err) {
+			emptyPolls++
+			if emptyPolls > 1 {
+				sleep = p.pollBackoff.Delay(emptyPolls - 1)
+			}
+		} else {
+			errChan <- err
+		}
+
+		if sleep <= 0 {
+			select {
+			case _ = <-p.stopChan:
+				{
+					return
+				}
+			default:
+			}
+			continue
 		}
 
+		timer := time.NewTimer(sleep)
 		select {
 		case _ = <-p.stopChan:
 			{
+				timer.Stop()
 				return
 			}
-		default:
+		case <-timer.C:
 		}
 	}
+}
+
+func (p *MQSQueue) receiveOnce(resource string) (resp MessageReceiveResponse, err error) {
+	if _, err = p.client.Send(GET, nil, nil, resource, &resp); err == nil && p.verifyMD5 {
+		err = verifyMessageBodyMD5(p.name, resp.MessageId, resp.MessageBody, resp.MessageBodyMD5)
+	}
+
+	if err == nil {
+		var decoded []byte
+		if decoded, err = p.decodeBody(resp.MessageBody); err != nil {
+			err = &MessageDecodeError{
+				ErrCode:  ERR_MQS_DECODE_BODY_FAILED.New(errors.Params{"queue": p.name, "err": err}),
+				Response: resp,
+				Cause:    err,
+			}
+		} else {
+			resp.wireBody = resp.MessageBody
+			resp.MessageBody = decoded
+		}
+	}
+
+	if err == nil {
+		atomic.AddInt64(&p.received, 1)
+	} else if ERR_MQS_MESSAGE_NOT_EXIST.IsEqual(err) {
+		atomic.AddInt64(&p.emptyPolls, 1)
+	} else {
+		atomic.AddInt64(&p.errors, 1)
+	}
+	return
+}
+
+// MessageDecodeError is an ERR_MQS_DECODE_BODY_FAILED for a received message
+// the body filters could not decode, Cause is the error of the filter, such
+// as ERR_MQS_MESSAGE_TAMPERED. Response holds the message with the body as
+// received, so it could be deleted or dead lettered instead of coming back
+// after every visibility timeout. Its body is not released by BodyReleaser
+// filters when it is deleted.
+type MessageDecodeError struct {
+	errors.ErrCode
+	Response MessageReceiveResponse
+	Cause    error
+}
+
+// Receive returns one message, or ERR_MQS_NO_MESSAGE if the queue stayed
+// empty for the wait seconds. A message received after ctx is done stays
+// invisible until its visibility timeout expires.
+func (p *MQSQueue) Receive(ctx context.Context, waitseconds ...int64) (msg *Message, err error) {
+	wait := int64(-1)
+	if waitseconds != nil && len(waitseconds) == 1 {
+		wait = waitseconds[0]
+	}
+
+	return p.receive(ctx, p.receiveResource(wait, false))
+}
+
+func (p *MQSQueue) Peek(ctx context.Context) (msg *Message, err error) {
+	return p.receive(ctx, p.receiveResource(-1, true))
+}
+
+func (p *MQSQueue) receive(ctx context.Context, resource string) (msg *Message, err error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	type result struct {
+		resp MessageReceiveResponse
+		err  error
+	}
+
+	resultChan := make(chan result, 1)
+
+	go func() {
+		resp, e := p.receiveOnce(resource)
+		resultChan <- result{resp: resp, err: e}
+	}()
+
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	case r := <-resultChan:
+		if ERR_MQS_MESSAGE_NOT_EXIST.IsEqual(r.err) {
+			err = ERR_MQS_NO_MESSAGE.New(errors.Params{"queue": p.name})
+			return
+		} else if r.err != nil {
+			err = r.err
+			return
+		}
+		msg = NewMessage(p, r.resp)
+	}
 
 	return
 }
 
 func (p *MQSQueue) PeekMessage(respChan chan MessageReceiveResponse, errChan chan error) {
 	for {
-		resp := MessageReceiveResponse{}
-		_, err := p.client.Send(GET, nil, nil, fmt.Sprintf("%s/%s?peekonly=true", p.name, "messages"), &resp)
+		resp, err := p.receiveOnce(p.receiveResource(-1, true))
 		if err != nil {
 			errChan <- err
 		} else {
@@ -118,3 +403,119 @@ func (p *MQSQueue) ChangeMessageVisibility(receiptHandle string, visibilityTimeo
 	_, err = p.client.Send(PUT, nil, nil, fmt.Sprintf("%s/%s?ReceiptHandle=%s&VisibilityTimeout=%d", p.name, "messages", receiptHandle, visibilityTimeout), &resp)
 	return
 }
+
+func (p *MQSQueue) GetAttributes() (attr QueueAttribute, err error) {
+	_, err = p.client.Send(GET, nil, nil, p.name, &attr)
+	return
+}
+
+// RefreshAttributes reloads the attributes used to validate sent messages.
+func (p *MQSQueue) RefreshAttributes() (attr QueueAttribute, err error) {
+	p.attrLocker.Lock()
+	defer p.attrLocker.Unlock()
+
+	return p.loadAttributes()
+}
+
+func (p *MQSQueue) loadAttributes() (attr QueueAttribute, err error) {
+	// a failed load is cached too, so an unreachable service is not asked
+	// again on every send
+	p.attrLoadTime = time.Now()
+
+	if attr, err = p.GetAttributes(); err != nil {
+		return
+	}
+
+	p.attr = attr
+
+	return
+}
+
+func (p *MQSQueue) maxMessageSize() int32 {
+	if !p.validateSend {
+		return MaxMessageSize
+	}
+
+	p.attrLocker.Lock()
+	defer p.attrLocker.Unlock()
+
+	if time.Since(p.attrLoadTime) >= p.attrTTL {
+		p.loadAttributes()
+	}
+
+	if p.attr.MaxMessageSize > 0 {
+		return p.attr.MaxMessageSize
+	}
+
+	return MaxMessageSize
+}
+
+func (p *MQSQueue) checkMessageSize(body []byte) (err error) {
+	// the size limit applies to the body as it is on the wire
+	size := base64.StdEncoding.EncodedLen(len(body))
+	if max := p.maxMessageSize(); int64(size) > int64(max) {
+		err = ERR_MQS_MESSAGE_BODY_TOO_LARGE.New(errors.Params{"queue": p.name, "size": size, "max": max})
+		return
+	}
+
+	return
+}
+
+// checkMessagePriority accepts 0, which the service takes as the default
+// priority of the queue.
+func checkMessagePriority(priority int64) (err error) {
+	if priority != 0 && (priority < MinMessagePriority || priority > MaxMessagePriority) {
+		err = ERR_MQS_MESSAGE_PRIORITY_RANGE_ERROR.New(errors.Params{"priority": priority})
+		return
+	}
+	return
+}
+
+func checkMessageDelaySeconds(seconds int64) (err error) {
+	if seconds < 0 || seconds > MaxMessageDelaySeconds {
+		err = ERR_MQS_MESSAGE_DELAY_SECONDS_RANGE_ERROR.New(errors.Params{"delay": seconds})
+		return
+	}
+	return
+}
+
+func (p *MQSQueue) encodeBody(body []byte) (encoded []byte, err error) {
+	encoded = body
+	for _, filter := range p.filters {
+		if encoded, err = filter.EncodeBody(encoded); err != nil {
+			err = ERR_MQS_ENCODE_BODY_FAILED.New(errors.Params{"queue": p.name, "err": err})
+			return
+		}
+	}
+	return
+}
+
+func (p *MQSQueue) decodeBody(body []byte) (decoded []byte, err error) {
+	decoded = body
+	for i := len(p.filters) - 1; i >= 0; i-- {
+		if decoded, err = p.filters[i].DecodeBody(decoded); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// releaseMessage lets body filters clean up after the message was deleted,
+// they are given the body as it was received.
+func (p *MQSQueue) releaseMessage(resp MessageReceiveResponse) {
+	if resp.wireBody == nil {
+		return
+	}
+
+	p.releaseBody(resp.wireBody)
+}
+
+func (p *MQSQueue) releaseBody(body []byte) {
+	for i := len(p.filters) - 1; i >= 0; i-- {
+		if releaser, ok := p.filters[i].(BodyReleaser); ok {
+			if e := releaser.ReleaseBody(body); e != nil && p.onReleaseError != nil {
+				p.onReleaseError(body, e)
+			}
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package ali_mqs
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gogap/errors"
+)
+
+const (
+	DefaultQueueDelaySeconds           int32 = 0
+	DefaultQueueMaxMessageSize         int32 = 65536
+	DefaultQueueMessageRetentionPeriod int32 = 129600
+	DefaultQueueVisibilityTimeout      int32 = 30
+	DefaultQueuePollingWaitSeconds     int32 = 0
+)
+
+// QueueAttributes holds the attributes to create a queue with or to change,
+// nil fields are left to the service.
+type QueueAttributes struct {
+	DelaySeconds           *int32 `json:"delay_seconds,omitempty" yaml:"delay_seconds,omitempty"`
+	MaxMessageSize         *int32 `json:"maximum_message_size,omitempty" yaml:"maximum_message_size,omitempty"`
+	MessageRetentionPeriod *int32 `json:"message_retention_period,omitempty" yaml:"message_retention_period,omitempty"`
+	VisibilityTimeout      *int32 `json:"visibility_timeout,omitempty" yaml:"visibility_timeout,omitempty"`
+	PollingWaitSeconds     *int32 `json:"polling_wait_seconds,omitempty" yaml:"polling_wait_seconds,omitempty"`
+}
+
+type queueAttributesRequest struct {
+	XMLName                xml.Name `xml:"Queue"`
+	DelaySeconds           *int32   `xml:"DelaySenconds,omitempty"`
+	MaxMessageSize         *int32   `xml:"MaximumMessageSize,omitempty"`
+	MessageRetentionPeriod *int32   `xml:"MessageRetentionPeriod,omitempty"`
+	VisibilityTimeout      *int32   `xml:"VisibilityTimeout,omitempty"`
+	PollingWaitSeconds     *int32   `xml:"PollingWaitSeconds,omitempty"`
+}
+
+func Int32(v int32) *int32 {
+	return &v
+}
+
+func DefaultQueueAttributes() QueueAttributes {
+	return QueueAttributes{
+		DelaySeconds:           Int32(DefaultQueueDelaySeconds),
+		MaxMessageSize:         Int32(DefaultQueueMaxMessageSize),
+		MessageRetentionPeriod: Int32(DefaultQueueMessageRetentionPeriod),
+		VisibilityTimeout:      Int32(DefaultQueueVisibilityTimeout),
+		PollingWaitSeconds:     Int32(DefaultQueuePollingWaitSeconds),
+	}
+}
+
+func (p QueueAttributes) IsEmpty() bool {
+	return p.DelaySeconds == nil &&
+		p.MaxMessageSize == nil &&
+		p.MessageRetentionPeriod == nil &&
+		p.VisibilityTimeout == nil &&
+		p.PollingWaitSeconds == nil
+}
+
+// Check validates the fields which are set.
+func (p QueueAttributes) Check() (err error) {
+	if p.DelaySeconds != nil {
+		if err = checkDelaySeconds(*p.DelaySeconds); err != nil {
+			return
+		}
+	}
+	if p.MaxMessageSize != nil {
+		if err = checkMaxMessageSize(*p.MaxMessageSize); err != nil {
+			return
+		}
+	}
+	if p.MessageRetentionPeriod != nil {
+		if err = checkMessageRetentionPeriod(*p.MessageRetentionPeriod); err != nil {
+			return
+		}
+	}
+	if p.VisibilityTimeout != nil {
+		if err = checkVisibilityTimeout(*p.VisibilityTimeout); err != nil {
+			return
+		}
+	}
+	if p.PollingWaitSeconds != nil {
+		if err = checkPollingWaitSeconds(*p.PollingWaitSeconds); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Changes returns the fields which are set and differ from current.
+func (p QueueAttributes) Changes(current QueueAttribute) (changes QueueAttributes) {
+	changed := func(v *int32, currentValue int32) *int32 {
+		if v == nil || *v == currentValue {
+			return nil
+		}
+		return v
+	}
+
+	changes.DelaySeconds = changed(p.DelaySeconds, current.DelaySeconds)
+	changes.MaxMessageSize = changed(p.MaxMessageSize, current.MaxMessageSize)
+	changes.MessageRetentionPeriod = changed(p.MessageRetentionPeriod, current.MessageRetentionPeriod)
+	changes.VisibilityTimeout = changed(p.VisibilityTimeout, current.VisibilityTimeout)
+	changes.PollingWaitSeconds = changed(p.PollingWaitSeconds, current.PollingWaitSeconds)
+
+	return
+}
+
+func (p QueueAttributes) request() queueAttributesRequest {
+	return queueAttributesRequest{
+		DelaySeconds:           p.DelaySeconds,
+		MaxMessageSize:         p.MaxMessageSize,
+		MessageRetentionPeriod: p.MessageRetentionPeriod,
+		VisibilityTimeout:      p.VisibilityTimeout,
+		PollingWaitSeconds:     p.PollingWaitSeconds,
+	}
+}
+
+func (p *MQSQueueManager) CreateQueueWithAttributes(location MQSLocation, queueName string, attrs QueueAttributes) (err error) {
+	queueName = strings.TrimSpace(queueName)
+
+	if err = checkQueueName(queueName); err != nil {
+		return
+	}
+
+	if err = attrs.Check(); err != nil {
+		return
+	}
+
+	var cli MQSClient
+	if cli, err = p.client(location); err != nil {
+		return
+	}
+
+	message := attrs.request()
+
+	var code int
+	code, err = cli.Send(PUT, nil, &message, queueName, nil)
+
+	if code == http.StatusNoContent {
+		err = ERR_MQS_QUEUE_ALREADY_EXIST_AND_HAVE_SAME_ATTR.New(errors.Params{"name": queueName})
+		return
+	}
+
+	return
+}
+
+// UpdateQueueAttributes sends only the attributes which are set and differ
+// from the current ones, nothing is sent if none changed.
+func (p *MQSQueueManager) UpdateQueueAttributes(location MQSLocation, queueName string, attrs QueueAttributes) (changes QueueAttributes, err error) {
+	queueName = strings.TrimSpace(queueName)
+
+	if err = checkQueueName(queueName); err != nil {
+		return
+	}
+
+	if err = attrs.Check(); err != nil {
+		return
+	}
+
+	var current QueueAttribute
+	if current, err = p.GetQueueAttributes(location, queueName); err != nil {
+		return
+	}
+
+	if changes = attrs.Changes(current); changes.IsEmpty() {
+		return
+	}
+
+	err = p.setQueueAttributes(location, queueName, changes)
+
+	return
+}
+
+func (p *MQSQueueManager) setQueueAttributes(location MQSLocation, queueName string, attrs QueueAttributes) (err error) {
+	var cli MQSClient
+	if cli, err = p.client(location); err != nil {
+		return
+	}
+
+	message := attrs.request()
+
+	_, err = cli.Send(PUT, nil, &message, fmt.Sprintf("%s?metaoverride=true", queueName), nil)
+
+	return
+}
@@ -0,0 +1,188 @@
+package ali_mqs
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultListQueueConcurrency = 8
+)
+
+// Name returns the queue name, the last path element of QueueURL.
+func (p Queue) Name() string {
+	url := strings.TrimRight(p.QueueURL, "/")
+	return url[strings.LastIndex(url, "/")+1:]
+}
+
+// Marker returns NextMarker as the service sent it, ready to be passed to
+// ListQueue for the next page.
+func (p Queues) Marker() string {
+	if len(p.NextMarker) == 0 {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(p.NextMarker)
+}
+
+// QueueIterator walks all queues of a location page by page, following the
+// markers until the last page.
+type QueueIterator struct {
+	ctx      context.Context
+	manager  AliQueueManager
+	location MQSLocation
+	prefix   string
+	pageSize int32
+
+	page    []Queue
+	marker  string
+	last    bool
+	current Queue
+	err     error
+}
+
+func NewQueueIterator(ctx context.Context, manager AliQueueManager, location MQSLocation, prefix string, pageSize int32) *QueueIterator {
+	if manager == nil {
+		panic("ali_mqs: queue manager could not be nil")
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return &QueueIterator{
+		ctx:      ctx,
+		manager:  manager,
+		location: location,
+		prefix:   prefix,
+		pageSize: pageSize,
+	}
+}
+
+func (p *QueueIterator) Next() bool {
+	for len(p.page) == 0 {
+		if p.last || p.err != nil {
+			return false
+		}
+
+		if p.err = p.ctx.Err(); p.err != nil {
+			return false
+		}
+
+		var queues Queues
+		if queues, p.err = p.manager.ListQueue(p.location, p.marker, p.pageSize, p.prefix); p.err != nil {
+			return false
+		}
+
+		p.page = queues.Queue
+		p.marker = queues.Marker()
+		p.last = p.marker == ""
+	}
+
+	p.current, p.page = p.page[0], p.page[1:]
+
+	return true
+}
+
+func (p *QueueIterator) Queue() Queue {
+	return p.current
+}
+
+func (p *QueueIterator) Err() error {
+	return p.err
+}
+
+type ListQueuesOptions struct {
+	PageSize int32
+
+	// WithAttributes fetches the attributes of every queue, Concurrency of
+	// them at a time.
+	WithAttributes bool
+	Concurrency    int
+}
+
+type QueueInfo struct {
+	Name      string          `json:"name"`
+	URL       string          `json:"url"`
+	Attribute *QueueAttribute `json:"attribute,omitempty"`
+}
+
+func ListAllQueues(ctx context.Context, manager AliQueueManager, location MQSLocation, prefix string, options ListQueuesOptions) (queues []QueueInfo, err error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	iterator := NewQueueIterator(ctx, manager, location, prefix, options.PageSize)
+	for iterator.Next() {
+		queue := iterator.Queue()
+		queues = append(queues, QueueInfo{Name: queue.Name(), URL: queue.QueueURL})
+	}
+
+	if err = iterator.Err(); err != nil {
+		return nil, err
+	}
+
+	if !options.WithAttributes {
+		return
+	}
+
+	if err = fetchQueueAttributes(ctx, manager, location, queues, options.Concurrency); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+func fetchQueueAttributes(ctx context.Context, manager AliQueueManager, location MQSLocation, queues []QueueInfo, concurrency int) (err error) {
+	if concurrency <= 0 {
+		concurrency = DefaultListQueueConcurrency
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var errOnce sync.Once
+	fail := func(e error) {
+		errOnce.Do(func() {
+			err = e
+			cancel()
+		})
+	}
+
+	indexChan := make(chan int)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < concurrency && i < len(queues); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexChan {
+				attr, e := manager.GetQueueAttributes(location, queues[index].Name)
+				if e != nil {
+					fail(e)
+					continue
+				}
+				queues[index].Attribute = &attr
+			}
+		}()
+	}
+
+feed:
+	for i := range queues {
+		select {
+		case <-ctx.Done():
+			break feed
+		case indexChan <- i:
+		}
+	}
+
+	close(indexChan)
+	wg.Wait()
+
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	return
+}
@@ -1,12 +1,9 @@
 package ali_mqs
 
 import (
-	"fmt"
-	"net/http"
 	"strconv"
 	"strings"
-
-	"github.com/gogap/errors"
+	"sync"
 )
 
 type MQSLocation string
@@ -15,6 +12,11 @@ const (
 	Beijing  MQSLocation = "beijing"
 	Hangzhou MQSLocation = "hangzhou"
 	Qingdao  MQSLocation = "qingdao"
+	Shanghai MQSLocation = "shanghai"
+	Shenzhen MQSLocation = "shenzhen"
+	HongKong MQSLocation = "hongkong"
+
+	Singapore MQSLocation = "ap-southeast-1"
 )
 
 type AliQueueManager interface {
@@ -25,11 +27,52 @@ type AliQueueManager interface {
 	ListQueue(location MQSLocation, marker string, retNumber int32, prefix string) (queues Queues, err error)
 }
 
+// QueueAttributesManager is implemented by queue managers which create and
+// update queues with QueueAttributes, as needed by Provisioner.
+type QueueAttributesManager interface {
+	CreateQueueWithAttributes(location MQSLocation, queueName string, attrs QueueAttributes) (err error)
+	UpdateQueueAttributes(location MQSLocation, queueName string, attrs QueueAttributes) (changes QueueAttributes, err error)
+}
+
+type QueueFactory interface {
+	NewQueue(location MQSLocation, queueName string, options ...QueueOption) (queue AliMQSQueue, err error)
+}
+
+type QueueManagerOption func(manager *MQSQueueManager)
+
+// WithClientFactory replaces NewAliMQSClient, so tests can inject clients.
+func WithClientFactory(factory ClientFactory) QueueManagerOption {
+	return func(manager *MQSQueueManager) {
+		manager.clientFactory = factory
+	}
+}
+
+// WithEndpointResolver replaces DefaultEndpoint.
+func WithEndpointResolver(resolver EndpointResolver) QueueManagerOption {
+	return func(manager *MQSQueueManager) {
+		manager.resolver = resolver
+	}
+}
+
+// WithClientOptions configures the clients of the manager, usually with the
+// options the data plane clients are created with.
+func WithClientOptions(options ...ClientOption) QueueManagerOption {
+	return func(manager *MQSQueueManager) {
+		manager.clientOptions = append(manager.clientOptions, options...)
+	}
+}
+
 type MQSQueueManager struct {
 	ownerId         string
 	credential      Credential
 	accessKeyId     string
 	accessKeySecret string
+
+	resolver      EndpointResolver
+	clientFactory ClientFactory
+	clientOptions []ClientOption
+	clientsLocker sync.Mutex
+	clients       map[MQSLocation]MQSClient
 }
 
 func checkQueueName(queueName string) (err error) {
@@ -41,7 +84,7 @@ func checkQueueName(queueName string) (err error) {
 }
 
 func checkDelaySeconds(seconds int32) (err error) {
-	if seconds > 60480 || seconds < 0 {
+	if seconds > 604800 || seconds < 0 {
 		err = ERR_MQS_DELAY_SECONDS_RANGE_ERROR.New()
 		return
 	}
@@ -80,99 +123,83 @@ func checkPollingWaitSeconds(pollingWaitSeconds int32) (err error) {
 	return
 }
 
-func NewMQSQueueManager(ownerId, accessKeyId, accessKeySecret string) AliQueueManager {
-	return &MQSQueueManager{
+func NewMQSQueueManager(ownerId, accessKeyId, accessKeySecret string, options ...QueueManagerOption) AliQueueManager {
+	manager := &MQSQueueManager{
 		ownerId:         ownerId,
 		accessKeyId:     accessKeyId,
 		accessKeySecret: accessKeySecret,
+		resolver:        DefaultEndpoint,
+		clientFactory:   NewAliMQSClient,
+		clients:         make(map[MQSLocation]MQSClient),
 	}
-}
 
-func checkAttributes(delaySeconds int32, maxMessageSize int32, messageRetentionPeriod int32, visibilityTimeout int32, pollingWaitSeconds int32) (err error) {
-	if err = checkDelaySeconds(delaySeconds); err != nil {
-		return
-	}
-	if err = checkMaxMessageSize(maxMessageSize); err != nil {
-		return
-	}
-	if err = checkMessageRetentionPeriod(messageRetentionPeriod); err != nil {
-		return
+	for _, option := range options {
+		option(manager)
 	}
-	if err = checkVisibilityTimeout(visibilityTimeout); err != nil {
-		return
-	}
-	if err = checkPollingWaitSeconds(pollingWaitSeconds); err != nil {
-		return
-	}
-	return
+
+	return manager
 }
 
-func (p *MQSQueueManager) CreateQueue(location MQSLocation, queueName string, delaySeconds int32, maxMessageSize int32, messageRetentionPeriod int32, visibilityTimeout int32, pollingWaitSeconds int32) (err error) {
-	queueName = strings.TrimSpace(queueName)
+// client returns the client of location, which is created once and shared
+// by all calls so connections are reused.
+func (p *MQSQueueManager) client(location MQSLocation) (cli MQSClient, err error) {
+	p.clientsLocker.Lock()
+	defer p.clientsLocker.Unlock()
 
-	if err = checkQueueName(queueName); err != nil {
+	if cli = p.clients[location]; cli != nil {
 		return
 	}
 
-	if err = checkAttributes(delaySeconds,
-		maxMessageSize,
-		messageRetentionPeriod,
-		visibilityTimeout,
-		pollingWaitSeconds); err != nil {
+	if cli, err = p.newClient(location); err != nil {
 		return
 	}
 
-	message := CreateQueueRequest{
-		DelaySeconds:           delaySeconds,
-		MaxMessageSize:         maxMessageSize,
-		MessageRetentionPeriod: messageRetentionPeriod,
-		VisibilityTimeout:      visibilityTimeout,
-		PollingWaitSeconds:     pollingWaitSeconds,
-	}
-
-	url := fmt.Sprintf("http://%s.mqs-cn-%s.aliyuncs.com", p.ownerId, string(location))
-
-	cli := NewAliMQSClient(url, p.accessKeyId, p.accessKeySecret)
-
-	var code int
-	code, err = cli.Send(PUT, nil, &message, queueName, nil)
-
-	if code == http.StatusNoContent {
-		err = ERR_MQS_QUEUE_ALREADY_EXIST_AND_HAVE_SAME_ATTR.New(errors.Params{"name": queueName})
-		return
-	}
+	p.clients[location] = cli
 
 	return
 }
 
-func (p *MQSQueueManager) SetQueueAttributes(location MQSLocation, queueName string, delaySeconds int32, maxMessageSize int32, messageRetentionPeriod int32, visibilityTimeout int32, pollingWaitSeconds int32) (err error) {
-	queueName = strings.TrimSpace(queueName)
-
-	if err = checkQueueName(queueName); err != nil {
+func (p *MQSQueueManager) newClient(location MQSLocation) (cli MQSClient, err error) {
+	var url string
+	if url, err = p.resolver.Resolve(p.ownerId, location); err != nil {
 		return
 	}
 
-	if err = checkAttributes(delaySeconds,
-		maxMessageSize,
-		messageRetentionPeriod,
-		visibilityTimeout,
-		pollingWaitSeconds); err != nil {
-		return
-	}
+	return p.clientFactory(url, p.accessKeyId, p.accessKeySecret, p.clientOptions...), nil
+}
 
-	message := CreateQueueRequest{
-		DelaySeconds:           delaySeconds,
-		MaxMessageSize:         maxMessageSize,
-		MessageRetentionPeriod: messageRetentionPeriod,
-		VisibilityTimeout:      visibilityTimeout,
-		PollingWaitSeconds:     pollingWaitSeconds,
+// NewQueue creates a queue of location with the endpoint and client options
+// of the manager. The queue gets a client of its own, as the proxy variables
+// NewMQSQueue reads would otherwise redirect the shared client.
+func (p *MQSQueueManager) NewQueue(location MQSLocation, queueName string, options ...QueueOption) (queue AliMQSQueue, err error) {
+	var cli MQSClient
+	if cli, err = p.newClient(location); err != nil {
+		return
 	}
 
-	url := fmt.Sprintf("http://%s.mqs-cn-%s.aliyuncs.com", p.ownerId, string(location))
+	return NewMQSQueue(queueName, cli, options...), nil
+}
 
-	cli := NewAliMQSClient(url, p.accessKeyId, p.accessKeySecret)
+func (p *MQSQueueManager) CreateQueue(location MQSLocation, queueName string, delaySeconds int32, maxMessageSize int32, messageRetentionPeriod int32, visibilityTimeout int32, pollingWaitSeconds int32) (err error) {
+	return p.CreateQueueWithAttributes(location, queueName, QueueAttributes{
+		DelaySeconds:           &delaySeconds,
+		MaxMessageSize:         &maxMessageSize,
+		MessageRetentionPeriod: &messageRetentionPeriod,
+		VisibilityTimeout:      &visibilityTimeout,
+		PollingWaitSeconds:     &pollingWaitSeconds,
+	})
+}
 
-	_, err = cli.Send(PUT, nil, &message, fmt.Sprintf("%s?metaoverride=true", queueName), nil)
+// SetQueueAttributes sends only the values which differ from the current
+// attributes, like UpdateQueueAttributes.
+func (p *MQSQueueManager) SetQueueAttributes(location MQSLocation, queueName string, delaySeconds int32, maxMessageSize int32, messageRetentionPeriod int32, visibilityTimeout int32, pollingWaitSeconds int32) (err error) {
+	_, err = p.UpdateQueueAttributes(location, queueName, QueueAttributes{
+		DelaySeconds:           &delaySeconds,
+		MaxMessageSize:         &maxMessageSize,
+		MessageRetentionPeriod: &messageRetentionPeriod,
+		VisibilityTimeout:      &visibilityTimeout,
+		PollingWaitSeconds:     &pollingWaitSeconds,
+	})
 	return
 }
 
@@ -183,9 +210,10 @@ func (p *MQSQueueManager) GetQueueAttributes(location MQSLocation, queueName str
 		return
 	}
 
-	url := fmt.Sprintf("http://%s.mqs-cn-%s.aliyuncs.com", p.ownerId, string(location))
-
-	cli := NewAliMQSClient(url, p.accessKeyId, p.accessKeySecret)
+	var cli MQSClient
+	if cli, err = p.client(location); err != nil {
+		return
+	}
 
 	_, err = cli.Send(GET, nil, nil, queueName, &attr)
 
@@ -199,9 +227,10 @@ func (p *MQSQueueManager) DeleteQueue(location MQSLocation, queueName string) (e
 		return
 	}
 
-	url := fmt.Sprintf("http://%s.mqs-cn-%s.aliyuncs.com", p.ownerId, string(location))
-
-	cli := NewAliMQSClient(url, p.accessKeyId, p.accessKeySecret)
+	var cli MQSClient
+	if cli, err = p.client(location); err != nil {
+		return
+	}
 
 	_, err = cli.Send(DELETE, nil, nil, queueName, nil)
 
@@ -210,9 +239,10 @@ func (p *MQSQueueManager) DeleteQueue(location MQSLocation, queueName string) (e
 
 func (p *MQSQueueManager) ListQueue(location MQSLocation, marker string, retNumber int32, prefix string) (queues Queues, err error) {
 
-	url := fmt.Sprintf("http://%s.mqs-cn-%s.aliyuncs.com", p.ownerId, string(location))
-
-	cli := NewAliMQSClient(url, p.accessKeyId, p.accessKeySecret)
+	var cli MQSClient
+	if cli, err = p.client(location); err != nil {
+		return
+	}
 
 	header := map[string]string{}
 
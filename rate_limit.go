@@ -0,0 +1,166 @@
+package ali_mqs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket, a rate not above zero means unlimited.
+type RateLimiter struct {
+	locker sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	limiter := &RateLimiter{}
+	limiter.SetRate(rate, burst)
+	return limiter
+}
+
+func (p *RateLimiter) SetRate(rate float64, burst int) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	// a new limiter starts with a full bucket
+	full := p.last.IsZero()
+
+	p.advance(time.Now())
+
+	p.rate = rate
+	p.burst = float64(burst)
+	if p.tokens > p.burst || full {
+		p.tokens = p.burst
+	}
+}
+
+func (p *RateLimiter) Rate() float64 {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return p.rate
+}
+
+func (p *RateLimiter) Wait(ctx context.Context) error {
+	for {
+		p.locker.Lock()
+		if p.rate <= 0 {
+			p.locker.Unlock()
+			return nil
+		}
+
+		now := time.Now()
+		p.advance(now)
+
+		if p.tokens >= 1 {
+			p.tokens--
+			p.locker.Unlock()
+			return nil
+		}
+
+		delay := time.Duration((1 - p.tokens) / p.rate * float64(time.Second))
+		p.locker.Unlock()
+
+		// wake up at least every second so a changed rate is picked up
+		if delay > time.Second {
+			delay = time.Second
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (p *RateLimiter) advance(now time.Time) {
+	if !p.last.IsZero() && p.rate > 0 {
+		p.tokens += now.Sub(p.last).Seconds() * p.rate
+		if p.tokens > p.burst {
+			p.tokens = p.burst
+		}
+	}
+	p.last = now
+}
+
+// InFlightLimiter bounds the messages held at once, a max not above zero
+// means unlimited.
+type InFlightLimiter struct {
+	locker      sync.Mutex
+	max         int
+	count       int
+	releaseChan chan bool
+}
+
+func NewInFlightLimiter(max int) *InFlightLimiter {
+	return &InFlightLimiter{
+		max:         max,
+		releaseChan: make(chan bool, 1),
+	}
+}
+
+func (p *InFlightLimiter) SetMax(max int) {
+	p.locker.Lock()
+	p.max = max
+	p.locker.Unlock()
+
+	notify(p.releaseChan)
+}
+
+func (p *InFlightLimiter) Max() int {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return p.max
+}
+
+func (p *InFlightLimiter) Count() int {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return p.count
+}
+
+func (p *InFlightLimiter) Acquire(ctx context.Context) error {
+	for {
+		p.locker.Lock()
+		if p.max <= 0 || p.count < p.max {
+			p.count++
+			more := p.max <= 0 || p.count < p.max
+			p.locker.Unlock()
+
+			// pass the wake up on to another waiter if there is still room
+			if more {
+				notify(p.releaseChan)
+			}
+			return nil
+		}
+		p.locker.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.releaseChan:
+		}
+	}
+}
+
+func (p *InFlightLimiter) Release() {
+	p.locker.Lock()
+	if p.count > 0 {
+		p.count--
+	}
+	p.locker.Unlock()
+
+	notify(p.releaseChan)
+}
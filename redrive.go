@@ -0,0 +1,139 @@
+package ali_mqs
+
+import (
+	"context"
+
+	"github.com/gogap/errors"
+)
+
+type RedriveFilter func(resp MessageReceiveResponse) bool
+
+type RedriveTransform func(resp MessageReceiveResponse) (message MessageSendRequest, err error)
+
+type RedriveOptions struct {
+	Filter      RedriveFilter
+	Transform   RedriveTransform
+	MaxMessages int64
+	WaitSeconds int64
+}
+
+type RedriveFailure struct {
+	MessageId string `json:"message_id"`
+	Err       error  `json:"error"`
+}
+
+type RedriveResult struct {
+	Received int64            `json:"received"`
+	Sent     int64            `json:"sent"`
+	Skipped  int64            `json:"skipped"`
+	Failed   int64            `json:"failed"`
+	Failures []RedriveFailure `json:"failures,omitempty"`
+}
+
+// DeadLetterTransform unwraps messages routed by DeadLetterRouter back to
+// their original body and priority, other messages are sent as they are.
+// Truncated dead letters fail and stay in the dead letter queue.
+func DeadLetterTransform(resp MessageReceiveResponse) (message MessageSendRequest, err error) {
+	message = MessageSendRequest{
+		MessageBody: resp.MessageBody,
+		Priority:    resp.Priority,
+	}
+
+	if deadLetter, e := ParseDeadLetterMessage(resp.MessageBody); e == nil && deadLetter.MessageId != "" {
+		if deadLetter.Truncated {
+			err = ERR_MQS_DEAD_LETTER_TRUNCATED.New(errors.Params{"id": deadLetter.MessageId, "size": deadLetter.BodySize})
+			return
+		}
+		message.MessageBody = deadLetter.MessageBody
+		message.Priority = deadLetter.Priority
+	}
+
+	return
+}
+
+// Redrive moves messages from source to target until source is empty, ctx is
+// done or MaxMessages were received. A message is deleted from source only
+// after it was sent to target, failed and filtered messages are left in place.
+func Redrive(ctx context.Context, source, target AliMQSQueue, options RedriveOptions) (result RedriveResult, err error) {
+	if options.Transform == nil {
+		options.Transform = DeadLetterTransform
+	}
+
+	var receiver MessageReceiver
+	if receiver, err = receiverOf(source); err != nil {
+		return
+	}
+
+	seen := make(map[string]bool)
+
+	for options.MaxMessages <= 0 || result.Received < options.MaxMessages {
+		var msg *Message
+		if options.WaitSeconds > 0 {
+			msg, err = receiver.Receive(ctx, options.WaitSeconds)
+		} else {
+			msg, err = receiver.Receive(ctx)
+		}
+
+		if decodeErr, ok := err.(*MessageDecodeError); ok {
+			// left in place like a failed message
+			err = nil
+			if seen[decodeErr.Response.MessageId] {
+				return
+			}
+			seen[decodeErr.Response.MessageId] = true
+			result.Received++
+			result.Failed++
+			result.Failures = append(result.Failures, RedriveFailure{MessageId: decodeErr.Response.MessageId, Err: decodeErr})
+			continue
+		}
+
+		if err != nil {
+			if ERR_MQS_NO_MESSAGE.IsEqual(err) {
+				err = nil
+			} else if err != ctx.Err() {
+				err = ERR_MQS_REDRIVE_RECEIVE_FAILED.New(errors.Params{"queue": source.Name(), "err": err})
+			}
+			return
+		}
+
+		resp := msg.MessageReceiveResponse
+
+		// skipped and failed messages come back once their visibility expires
+		if seen[resp.MessageId] {
+			return
+		}
+		seen[resp.MessageId] = true
+
+		result.Received++
+
+		if options.Filter != nil && !options.Filter(resp) {
+			result.Skipped++
+			continue
+		}
+
+		if e := redriveMessage(target, msg, options.Transform); e != nil {
+			result.Failed++
+			result.Failures = append(result.Failures, RedriveFailure{MessageId: resp.MessageId, Err: e})
+			continue
+		}
+
+		result.Sent++
+	}
+
+	return
+}
+
+func redriveMessage(target AliMQSQueue, msg *Message, transform RedriveTransform) (err error) {
+	var message MessageSendRequest
+	if message, err = transform(msg.MessageReceiveResponse); err != nil {
+		return
+	}
+
+	if _, err = target.SendMessage(message); err != nil {
+		return
+	}
+
+	err = msg.Ack()
+
+	return
+}
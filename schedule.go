@@ -0,0 +1,75 @@
+package ali_mqs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gogap/errors"
+)
+
+const (
+	bodyHeaderDeliverAt = "at"
+)
+
+// SendAt sends message to be delivered at the given time. Times further away
+// than the max delay are sent wrapped in a relay envelope with the max delay,
+// receivers must handle them with ScheduleRelay, which sends them again until
+// the time has come. Every hop carries a new nonce, so hops of the same
+// message have different body MD5s and are not taken as duplicates.
+func SendAt(queue AliMQSQueue, at time.Time, message MessageSendRequest) (resp MessageSendResponse, err error) {
+	delay := int64((time.Until(at) + time.Second - 1) / time.Second)
+	if delay < 0 {
+		delay = 0
+	}
+
+	if delay > MaxMessageDelaySeconds {
+		nonce := make([]byte, 8)
+		if _, err = rand.Read(nonce); err != nil {
+			return
+		}
+
+		value := strconv.FormatInt(at.UnixNano()/int64(time.Millisecond), 10) + ":" + hex.EncodeToString(nonce)
+		message.MessageBody = encodeBodyHeader(bodyHeaderDeliverAt, value, message.MessageBody)
+		delay = MaxMessageDelaySeconds
+	}
+
+	message.DelaySeconds = delay
+
+	return queue.SendMessage(message)
+}
+
+// ScheduleRelay is a MessageMiddleware that sends relay envelopes created by
+// SendAt back to their queue while the delivery time is ahead, and unwraps
+// them for next once it has passed. Other messages go to next unchanged.
+func ScheduleRelay(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg *Message) (err error) {
+		value, payload, ok := decodeBodyHeader(msg.MessageBody, bodyHeaderDeliverAt)
+		if !ok {
+			return next(ctx, msg)
+		}
+
+		var millis int64
+		if millis, err = strconv.ParseInt(strings.SplitN(value, ":", 2)[0], 10, 64); err != nil {
+			err = ERR_MQS_INVALID_DELIVERY_TIME.New(errors.Params{"id": msg.MessageId, "at": value})
+			return
+		}
+
+		at := time.Unix(0, millis*int64(time.Millisecond))
+		if time.Now().Before(at) {
+			// the relayed message is acked by the consumer once this returns
+			_, err = SendAt(msg.Queue(), at, MessageSendRequest{
+				MessageBody: payload,
+				Priority:    msg.Priority,
+			})
+			return
+		}
+
+		msg.MessageBody = payload
+
+		return next(ctx, msg)
+	}
+}
@@ -0,0 +1,385 @@
+package ali_mqs
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogap/errors"
+)
+
+const (
+	spoolLogFile    = "spool.log"
+	spoolCursorFile = "spool.cursor"
+
+	spoolRecordHeaderSize = 8
+
+	// the sent records are cut off the log once they are at least half of it
+	// and this large, or when the log is fully drained
+	spoolCompactMinBytes = 1024 * 1024
+
+	DefaultSpoolMaxBytes int64 = 64 * 1024 * 1024
+)
+
+type SpoolOptions struct {
+	Dir string
+
+	// MaxBytes bounds the size of the log file, sent records included until
+	// they are compacted away.
+	MaxBytes int64
+	Backoff  Backoff
+
+	// OnDrop is called with messages the service rejected during replay, they
+	// are removed from the spool so the messages after them can be sent.
+	OnDrop func(message MessageSendRequest, err error)
+}
+
+type SpoolStats struct {
+	Depth   int64 `json:"depth"`
+	Bytes   int64 `json:"bytes"`
+	Spooled int64 `json:"spooled"`
+	Drained int64 `json:"drained"`
+	Dropped int64 `json:"dropped"`
+}
+
+// OutboxSpool sends messages to queue and appends them to a local log when
+// the send fails with a transient error. The log is replayed in order in the
+// background, and while it is not empty new messages are appended behind.
+type OutboxSpool struct {
+	queue   AliMQSQueue
+	options SpoolOptions
+
+	locker sync.Mutex
+	log    *os.File
+	size   int64
+	offset int64
+	stats  SpoolStats
+
+	wakeChan chan bool
+	stopChan chan bool
+	doneChan chan bool
+	stopOnce sync.Once
+}
+
+func NewOutboxSpool(queue AliMQSQueue, options SpoolOptions) (spool *OutboxSpool, err error) {
+	if queue == nil {
+		panic("ali_mqs: spool queue could not be nil")
+	}
+
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = DefaultSpoolMaxBytes
+	}
+
+	if options.Backoff == nil {
+		options.Backoff = DefaultPollBackoff
+	}
+
+	if err = os.MkdirAll(options.Dir, 0755); err != nil {
+		return
+	}
+
+	spool = &OutboxSpool{
+		queue:    queue,
+		options:  options,
+		wakeChan: make(chan bool, 1),
+		stopChan: make(chan bool),
+		doneChan: make(chan bool),
+	}
+
+	if err = spool.open(); err != nil {
+		return nil, err
+	}
+
+	go spool.drain()
+
+	return
+}
+
+// SendMessage reports spooled when message was appended to the spool instead
+// of being sent, it is sent later by the drainer.
+func (p *OutboxSpool) SendMessage(message MessageSendRequest) (resp MessageSendResponse, spooled bool, err error) {
+	if p.Stats().Depth == 0 {
+		if resp, err = p.queue.SendMessage(message); err == nil || !IsTransientError(err) {
+			return
+		}
+	}
+
+	if err = p.append(message); err != nil {
+		return
+	}
+
+	notify(p.wakeChan)
+
+	return resp, true, nil
+}
+
+func (p *OutboxSpool) Stats() SpoolStats {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	stats := p.stats
+	stats.Bytes = p.size - p.offset
+
+	return stats
+}
+
+func (p *OutboxSpool) Close() (err error) {
+	p.stopOnce.Do(func() {
+		close(p.stopChan)
+		<-p.doneChan
+
+		p.locker.Lock()
+		err = p.log.Close()
+		p.locker.Unlock()
+	})
+	return
+}
+
+func (p *OutboxSpool) open() (err error) {
+	if p.log, err = os.OpenFile(filepath.Join(p.options.Dir, spoolLogFile), os.O_CREATE|os.O_RDWR, 0644); err != nil {
+		return
+	}
+
+	if data, e := ioutil.ReadFile(filepath.Join(p.options.Dir, spoolCursorFile)); e == nil {
+		p.offset, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	}
+
+	var info os.FileInfo
+	if info, err = p.log.Stat(); err != nil {
+		return
+	}
+
+	// the cursor is saved before the log is compacted, so a cursor past the
+	// end only remains if the log was lost, and the log is read from its start
+	if p.offset < 0 || p.offset > info.Size() {
+		p.offset = 0
+	}
+
+	// count the records after the cursor and cut off a record torn by a crash
+	offset := p.offset
+	for {
+		_, next, e := p.readAt(offset)
+		if e != nil {
+			break
+		}
+		offset = next
+		p.stats.Depth++
+	}
+
+	if err = p.log.Truncate(offset); err != nil {
+		return
+	}
+
+	p.size = offset
+
+	_, err = p.log.Seek(p.size, io.SeekStart)
+
+	return
+}
+
+func (p *OutboxSpool) append(message MessageSendRequest) (err error) {
+	var data []byte
+	if data, err = xml.Marshal(message); err != nil {
+		err = ERR_MARSHAL_MESSAGE_FAILED.New(errors.Params{"err": err})
+		return
+	}
+
+	record := make([]byte, spoolRecordHeaderSize, spoolRecordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(data))
+	record = append(record, data...)
+
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if p.size+int64(len(record)) > p.options.MaxBytes && p.offset > 0 {
+		if err = p.compact(); err != nil {
+			err = ERR_MQS_SPOOL_WRITE_FAILED.New(errors.Params{"queue": p.queue.Name(), "err": err})
+			return
+		}
+	}
+
+	if p.size+int64(len(record)) > p.options.MaxBytes {
+		err = ERR_MQS_SPOOL_FULL.New(errors.Params{"queue": p.queue.Name(), "max": p.options.MaxBytes})
+		return
+	}
+
+	if _, err = p.log.Write(record); err == nil {
+		err = p.log.Sync()
+	}
+
+	if err != nil {
+		err = ERR_MQS_SPOOL_WRITE_FAILED.New(errors.Params{"queue": p.queue.Name(), "err": err})
+		return
+	}
+
+	p.size += int64(len(record))
+	p.stats.Depth++
+	p.stats.Spooled++
+
+	return
+}
+
+func (p *OutboxSpool) readAt(offset int64) (message MessageSendRequest, next int64, err error) {
+	header := make([]byte, spoolRecordHeaderSize)
+	if _, err = p.log.ReadAt(header, offset); err != nil {
+		return
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err = p.log.ReadAt(data, offset+spoolRecordHeaderSize); err != nil {
+		return
+	}
+
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+
+	if err = xml.Unmarshal(data, &message); err != nil {
+		return
+	}
+
+	next = offset + spoolRecordHeaderSize + int64(len(data))
+
+	return
+}
+
+func (p *OutboxSpool) drain() {
+	defer close(p.doneChan)
+
+	failures := int64(0)
+
+	for {
+		if p.Stats().Depth == 0 {
+			select {
+			case <-p.stopChan:
+				return
+			case <-p.wakeChan:
+			}
+			continue
+		}
+
+		if failures > 0 {
+			timer := time.NewTimer(p.options.Backoff.Delay(failures))
+			select {
+			case <-p.stopChan:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		} else {
+			select {
+			case <-p.stopChan:
+				return
+			default:
+			}
+		}
+
+		if p.replay() {
+			failures = 0
+		} else {
+			failures++
+		}
+	}
+}
+
+// replay sends the record at the cursor. The log may be compacted by append
+// while the record is sent, so the cursor is advanced by the length of the
+// record rather than set to the offset it was read at.
+func (p *OutboxSpool) replay() (ok bool) {
+	p.locker.Lock()
+	offset := p.offset
+	message, next, err := p.readAt(offset)
+	p.locker.Unlock()
+
+	if err != nil {
+		return false
+	}
+
+	if _, err = p.queue.SendMessage(message); err != nil && IsTransientError(err) {
+		return false
+	}
+
+	if err != nil && p.options.OnDrop != nil {
+		p.options.OnDrop(message, err)
+	}
+
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.offset += next - offset
+	p.stats.Depth--
+	if err != nil {
+		p.stats.Dropped++
+	} else {
+		p.stats.Drained++
+	}
+
+	if p.offset == p.size || (p.offset >= spoolCompactMinBytes && p.offset*2 >= p.size) {
+		if p.compact() == nil {
+			return true
+		}
+	}
+
+	p.saveCursor(p.offset)
+
+	return true
+}
+
+// compact rewrites the log without the sent records. The cursor is reset
+// before the new log replaces the old one, so a crash in between sends the
+// sent records again rather than skipping unsent ones.
+func (p *OutboxSpool) compact() (err error) {
+	filename := filepath.Join(p.options.Dir, spoolLogFile)
+
+	var log *os.File
+	if log, err = os.OpenFile(filename+".tmp", os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644); err != nil {
+		return
+	}
+
+	if _, err = io.Copy(log, io.NewSectionReader(p.log, p.offset, p.size-p.offset)); err == nil {
+		err = log.Sync()
+	}
+
+	if err == nil {
+		err = p.saveCursor(0)
+	}
+
+	if err == nil {
+		if err = os.Rename(filename+".tmp", filename); err != nil {
+			p.saveCursor(p.offset)
+		}
+	}
+
+	if err != nil {
+		log.Close()
+		os.Remove(filename + ".tmp")
+		return
+	}
+
+	p.log.Close()
+	p.log = log
+	p.size -= p.offset
+	p.offset = 0
+
+	_, err = p.log.Seek(p.size, io.SeekStart)
+
+	return
+}
+
+func (p *OutboxSpool) saveCursor(offset int64) (err error) {
+	filename := filepath.Join(p.options.Dir, spoolCursorFile)
+	if err = ioutil.WriteFile(filename+".tmp", []byte(strconv.FormatInt(offset, 10)), 0644); err != nil {
+		return
+	}
+	return os.Rename(filename+".tmp", filename)
+}
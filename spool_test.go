@@ -0,0 +1,234 @@
+package ali_mqs
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// spoolQueue fails sends while failing is set and holds the send of the body
+// in hold until gate is closed.
+type spoolQueue struct {
+	locker  sync.Mutex
+	failing bool
+	sent    []string
+
+	hold    string
+	holding chan bool
+	gate    chan bool
+}
+
+func newSpoolQueue() *spoolQueue {
+	return &spoolQueue{
+		holding: make(chan bool, 1),
+		gate:    make(chan bool),
+	}
+}
+
+func (p *spoolQueue) Name() string {
+	return "spool"
+}
+
+func (p *spoolQueue) SendMessage(message MessageSendRequest) (resp MessageSendResponse, err error) {
+	p.locker.Lock()
+	failing := p.failing
+	p.locker.Unlock()
+
+	if failing {
+		err = ERR_SEND_REQUEST_FAILED.New()
+		return
+	}
+
+	if string(message.MessageBody) == p.hold {
+		p.holding <- true
+		<-p.gate
+	}
+
+	p.locker.Lock()
+	p.sent = append(p.sent, string(message.MessageBody))
+	p.locker.Unlock()
+
+	return
+}
+
+func (p *spoolQueue) setFailing(failing bool) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.failing = failing
+}
+
+func (p *spoolQueue) Sent() []string {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return append([]string(nil), p.sent...)
+}
+
+func (p *spoolQueue) ReceiveMessage(respChan chan MessageReceiveResponse, errChan chan error, waitseconds ...int64) {
+}
+
+func (p *spoolQueue) PeekMessage(respChan chan MessageReceiveResponse, errChan chan error) {
+}
+
+func (p *spoolQueue) DeleteMessage(receiptHandle string) (err error) {
+	return
+}
+
+func (p *spoolQueue) ChangeMessageVisibility(receiptHandle string, visibilityTimeout int64) (resp MessageVisibilityChangeResponse, err error) {
+	return
+}
+
+func (p *spoolQueue) Stop() {
+}
+
+func spoolRecordSize(t *testing.T, body string) int64 {
+	data, err := xml.Marshal(MessageSendRequest{MessageBody: Base64Bytes(body)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spoolRecordHeaderSize + int64(len(data))
+}
+
+func waitSent(t *testing.T, queue *spoolQueue, expected []string) {
+	deadline := time.Now().Add(time.Second * 5)
+	for len(queue.Sent()) < len(expected) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	if sent := queue.Sent(); !reflect.DeepEqual(sent, expected) {
+		t.Fatalf("sent %v, expected %v", sent, expected)
+	}
+}
+
+func waitDrained(spool *OutboxSpool) SpoolStats {
+	deadline := time.Now().Add(time.Second * 5)
+	for spool.Stats().Depth > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+	return spool.Stats()
+}
+
+func TestOutboxSpoolCompactDuringReplay(t *testing.T) {
+	queue := newSpoolQueue()
+	queue.failing = true
+	queue.hold = "b"
+
+	record := spoolRecordSize(t, "a")
+
+	spool, err := NewOutboxSpool(queue, SpoolOptions{
+		Dir:      t.TempDir(),
+		MaxBytes: record*4 - 1,
+		Backoff:  ExponentialBackoff{Initial: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	for _, body := range []string{"a", "b", "c"} {
+		if _, spooled, err := spool.SendMessage(MessageSendRequest{MessageBody: Base64Bytes(body)}); err != nil || !spooled {
+			t.Fatalf("spooled %v, err %v", spooled, err)
+		}
+	}
+
+	queue.setFailing(false)
+
+	select {
+	case <-queue.holding:
+	case <-time.After(time.Second * 5):
+		t.Fatal("b was not replayed")
+	}
+
+	// a is sent and b in flight, d does not fit until a is compacted away
+	if _, spooled, err := spool.SendMessage(MessageSendRequest{MessageBody: Base64Bytes("d")}); err != nil || !spooled {
+		t.Fatalf("spooled %v, err %v", spooled, err)
+	}
+
+	close(queue.gate)
+
+	waitSent(t, queue, []string{"a", "b", "c", "d"})
+
+	if stats := waitDrained(spool); stats.Depth != 0 || stats.Drained != 4 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestOutboxSpoolReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	queue := newSpoolQueue()
+	queue.failing = true
+
+	spool, err := NewOutboxSpool(queue, SpoolOptions{Dir: dir, Backoff: ExponentialBackoff{Initial: time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"a", "b", "c"} {
+		if _, spooled, err := spool.SendMessage(MessageSendRequest{MessageBody: Base64Bytes(body)}); err != nil || !spooled {
+			t.Fatalf("spooled %v, err %v", spooled, err)
+		}
+	}
+
+	if err = spool.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a record torn by a crash is cut off when the spool is opened again
+	log, err := os.OpenFile(filepath.Join(dir, spoolLogFile), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Write([]byte{0, 0, 1})
+	log.Close()
+
+	queue.setFailing(false)
+
+	if spool, err = NewOutboxSpool(queue, SpoolOptions{Dir: dir}); err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	waitSent(t, queue, []string{"a", "b", "c"})
+
+	if stats := waitDrained(spool); stats.Depth != 0 || stats.Bytes != 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+
+	// the drained log is compacted
+	if info, err := os.Stat(filepath.Join(dir, spoolLogFile)); err != nil || info.Size() != 0 {
+		t.Fatalf("log not compacted, err %v", err)
+	}
+}
+
+func TestOutboxSpoolFull(t *testing.T) {
+	queue := newSpoolQueue()
+	queue.failing = true
+
+	record := spoolRecordSize(t, "a")
+
+	spool, err := NewOutboxSpool(queue, SpoolOptions{
+		Dir:      t.TempDir(),
+		MaxBytes: record * 2,
+		Backoff:  ExponentialBackoff{Initial: time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	for _, body := range []string{"a", "b"} {
+		if _, _, err = spool.SendMessage(MessageSendRequest{MessageBody: Base64Bytes(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err = spool.SendMessage(MessageSendRequest{MessageBody: Base64Bytes("c")}); !ERR_MQS_SPOOL_FULL.IsEqual(err) {
+		t.Fatalf("err %v", err)
+	}
+}